@@ -1,7 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-systemd/unit"
 )
@@ -17,6 +21,34 @@ extractsdir = /var/lib/oci/extracts
 type OCIGenConfig struct {
 	ImageLayoutDir string
 	ExtractsDir    string
+	Platform       string // "os/arch[/variant]" to prefer from image indexes, instead of the host's
+	Generations    int    // extracted generations to keep of each ref. 0 is the default.
+
+	// KeepOrphans keeps extracted refs whose image layout (or ref) was removed,
+	// and their units generated
+	KeepOrphans bool
+	// GCMinAge is how old an extracted object must be to be garbage collected
+	GCMinAge time.Duration
+	// Storage is how extracted root filesystems are stored: "naive",
+	// "reflink" or "overlay"
+	Storage string
+	// CloneMode is how already extracted layers are cloned for an image
+	// built on them: "reflink", "hardlink", "copy" or "none"
+	CloneMode string
+	// Workers is how many images to extract at once. 0 is one per CPU.
+	Workers int
+	// LockTimeout is how long to wait for another run's lock on extractsdir.
+	// 0 is the default.
+	LockTimeout time.Duration
+	// StrictMetadata fails extracting an image whose files' metadata (like
+	// owners or xattrs) can not all be applied
+	StrictMetadata bool
+	// Rootless extracts as if not root (the default when not root), recording
+	// the files' owners in xattrs rather than changing them
+	Rootless bool
+	// IDMaps are the uid and gid ranges ("<uids> [<gids>]") that the owners of
+	// an image's files are shifted by, by image layout name
+	IDMaps map[string]string
 }
 
 // LoadConfigFromOptions reads from an INI style set of options
@@ -33,6 +65,63 @@ func LoadConfigFromOptions(r io.Reader) (*OCIGenConfig, error) {
 				cfg.ImageLayoutDir = opt.Value
 			case "extractsdir":
 				cfg.ExtractsDir = opt.Value
+			case "platform":
+				cfg.Platform = opt.Value
+			case "generations":
+				n, err := strconv.Atoi(opt.Value)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("generations must be a number of at least 1; got %q", opt.Value)
+				}
+				cfg.Generations = n
+			case "keeporphans":
+				b, err := strconv.ParseBool(opt.Value)
+				if err != nil {
+					return nil, fmt.Errorf("keeporphans must be true or false; got %q", opt.Value)
+				}
+				cfg.KeepOrphans = b
+			case "gcminage":
+				d, err := time.ParseDuration(opt.Value)
+				if err != nil {
+					return nil, fmt.Errorf("gcminage must be a duration (like \"24h\"); got %q", opt.Value)
+				}
+				cfg.GCMinAge = d
+			case "storage":
+				cfg.Storage = opt.Value
+			case "clonemode":
+				cfg.CloneMode = opt.Value
+			case "workers":
+				n, err := strconv.Atoi(opt.Value)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("workers must be a number of at least 1; got %q", opt.Value)
+				}
+				cfg.Workers = n
+			case "locktimeout":
+				d, err := time.ParseDuration(opt.Value)
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("locktimeout must be a duration (like \"30s\"); got %q", opt.Value)
+				}
+				cfg.LockTimeout = d
+			case "strictmetadata":
+				b, err := strconv.ParseBool(opt.Value)
+				if err != nil {
+					return nil, fmt.Errorf("strictmetadata must be true or false; got %q", opt.Value)
+				}
+				cfg.StrictMetadata = b
+			case "rootless":
+				b, err := strconv.ParseBool(opt.Value)
+				if err != nil {
+					return nil, fmt.Errorf("rootless must be true or false; got %q", opt.Value)
+				}
+				cfg.Rootless = b
+			case "idmap":
+				fields := strings.Fields(opt.Value)
+				if len(fields) < 2 {
+					return nil, fmt.Errorf("idmap must be \"<layout name> <uids> [<gids>]\"; got %q", opt.Value)
+				}
+				if cfg.IDMaps == nil {
+					cfg.IDMaps = map[string]string{}
+				}
+				cfg.IDMaps[fields[0]] = strings.Join(fields[1:], " ")
 			}
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestConfigLoad(t *testing.T) {
@@ -22,4 +23,67 @@ func TestConfigLoad(t *testing.T) {
 	if got != expect {
 		t.Errorf("expected %q; got %q", expect, got)
 	}
+	if cfg.Platform != "" {
+		t.Errorf("expected no platform by default; got %q", cfg.Platform)
+	}
+
+	cfg, err = LoadConfigFromOptions(strings.NewReader(DefaultConfig + "platform = linux/arm64/v8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = "linux/arm64/v8"
+	if cfg.Platform != expect {
+		t.Errorf("expected %q; got %q", expect, cfg.Platform)
+	}
+
+	if cfg.Generations != 0 {
+		t.Errorf("expected the default generations; got %d", cfg.Generations)
+	}
+
+	cfg, err = LoadConfigFromOptions(strings.NewReader(DefaultConfig + "generations = 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Generations != 5 {
+		t.Errorf("expected 5 generations; got %d", cfg.Generations)
+	}
+	for _, bad := range []string{"0", "-1", "three"} {
+		if _, err := LoadConfigFromOptions(strings.NewReader(DefaultConfig + "generations = " + bad + "\n")); err == nil {
+			t.Errorf("expected an error for generations = %q", bad)
+		}
+	}
+
+	cfg, err = LoadConfigFromOptions(strings.NewReader(DefaultConfig + "keeporphans = true\ngcminage = 36h\nlocktimeout = 2m\nworkers = 4\nstrictmetadata = true\nrootless = true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.KeepOrphans {
+		t.Error("expected orphans to be kept")
+	}
+	if cfg.GCMinAge != 36*time.Hour {
+		t.Errorf("expected a GC min age of 36h; got %s", cfg.GCMinAge)
+	}
+	if cfg.LockTimeout != 2*time.Minute {
+		t.Errorf("expected a lock timeout of 2m; got %s", cfg.LockTimeout)
+	}
+	if cfg.Workers != 4 {
+		t.Errorf("expected 4 workers; got %d", cfg.Workers)
+	}
+	if !cfg.StrictMetadata {
+		t.Error("expected strict metadata")
+	}
+	if !cfg.Rootless {
+		t.Error("expected rootless")
+	}
+
+	cfg, err = LoadConfigFromOptions(strings.NewReader(DefaultConfig + "idmap = example.com/app 0:100000:65536\nidmap = example.com/db 0:200000:65536 0:300000:65536\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.IDMaps) != 2 || cfg.IDMaps["example.com/app"] != "0:100000:65536" || cfg.IDMaps["example.com/db"] != "0:200000:65536 0:300000:65536" {
+		t.Errorf("expected the idmaps of two layouts; got %q", cfg.IDMaps)
+	}
+	if _, err := LoadConfigFromOptions(strings.NewReader(DefaultConfig + "idmap = example.com/app\n")); err == nil {
+		t.Error("expected an idmap without ranges to fail")
+	}
 }
@@ -0,0 +1,83 @@
+package extract
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+// ExtractResult is the outcome of extracting one manifest with ExtractAll
+type ExtractResult struct {
+	Manifest *layout.Manifest
+	Layout   *Layout // the extracted layout, if Err is nil
+	Err      error
+
+	// Metadata of the image's files that could not be applied
+	Metadata []MetadataError
+
+	// Devices are the image's device nodes not created, for Rootless
+	Devices []Device
+}
+
+// ExtractAll extracts manifests to rootpath, with up to workers extracting at
+// once (or one per CPU, if workers is less than 1). Manifests of the same
+// chainID are extracted one after the other by the same worker, so that their
+// layers are only applied once. Workers extracting images that share layers
+// wait on each other's locks for as long as that takes (see lockFile).
+//
+// The results are in the order of manifests, regardless of the order they
+// finished in.
+func ExtractAll(rootpath string, manifests []*layout.Manifest, workers int) []ExtractResult {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	results := make([]ExtractResult, len(manifests))
+
+	// indexes of manifests, grouped by chainID in the order first seen
+	groups := [][]int{}
+	byChainID := map[string]int{}
+	for i, m := range manifests {
+		results[i].Manifest = m
+		config, err := m.Config()
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		chainID, err := config.ChainID()
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if g, ok := byChainID[chainID.Name]; ok {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		byChainID[chainID.Name] = len(groups)
+		groups = append(groups, []int{i})
+	}
+	if workers > len(groups) {
+		workers = len(groups)
+	}
+
+	work := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range work {
+				for _, i := range group {
+					// each index is only written by the one worker
+					results[i] = ExtractWithResult(rootpath, manifests[i])
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		work <- group
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
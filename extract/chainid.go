@@ -0,0 +1,309 @@
+package extract
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+	"github.com/vbatts/oci-systemd-generator/util"
+	"golang.org/x/sys/unix"
+)
+
+// A chainID directory is only ever populated in a staging directory under
+// the extracts "tmp" directory, and then renamed into place. Once renamed, a
+// marker file alongside it (`<chainID dir>.complete`) records that it is
+// whole. A chainID directory without the marker is from an extraction that
+// did not finish (or is from before the markers), and can not be trusted.
+
+// chainIDComplete is whether the chainID directory at destpath was fully
+// extracted.
+func chainIDComplete(destpath string) bool {
+	if _, err := os.Stat(destpath + completeSuffix); err != nil {
+		return false
+	}
+	info, err := os.Stat(destpath)
+	return err == nil && info.IsDir()
+}
+
+// naiveSnapshotter is the Snapshotter of StorageNaive and StorageReflink. Its
+// snapshots are chainID directories, each with all the layers of its chainID
+// applied. A snapshot starts as a clone of its longest committed parent.
+type naiveSnapshotter struct {
+	l     Layout
+	clone CloneMode
+}
+
+func (s *naiveSnapshotter) Path(chainID *layout.DigestRef) (string, error) {
+	return s.l.chainIDPath(chainID.HashName(), chainID.Sum())
+}
+
+func (s *naiveSnapshotter) Committed(path string) bool {
+	return chainIDComplete(path)
+}
+
+func (s *naiveSnapshotter) Prepare(chainIDs []*layout.DigestRef) (Active, int, error) {
+	destpath, err := s.Path(chainIDs[len(chainIDs)-1])
+	if err != nil {
+		return nil, 0, err
+	}
+	tmp, err := s.l.tmpPath()
+	if err != nil {
+		return nil, 0, err
+	}
+	a := &naiveActive{tmp: tmp, staging: filepath.Join(tmp, nameRootfs), destpath: destpath}
+
+	// start from the longest prefix of the layers already extracted, if any
+	start, err := s.cloneParent(chainIDs, a.staging)
+	if err != nil {
+		a.Abort()
+		return nil, 0, err
+	}
+	if start == 0 {
+		if err := os.Mkdir(a.staging, os.FileMode(0755)); err != nil {
+			a.Abort()
+			return nil, 0, err
+		}
+	}
+	return a, start, nil
+}
+
+// cloneParent clones the chainID directory of the longest prefix of chainIDs
+// that is already extracted to staging, and returns how many layers it has.
+// Returns 0 (and staging is not created) if there is none, cloning is disabled
+// or failed. Failing to clone is only an error for cloneReflinkOnly.
+func (s *naiveSnapshotter) cloneParent(chainIDs []*layout.DigestRef, staging string) (int, error) {
+	if s.clone == CloneNone {
+		return 0, nil
+	}
+	// the last is the chainID being extracted
+	for i := len(chainIDs) - 2; i >= 0; i-- {
+		parent, err := s.Path(chainIDs[i])
+		if err != nil {
+			return 0, err
+		}
+		if !chainIDComplete(parent) {
+			continue
+		}
+		util.Debugf("cloning %q (%s) to %q", chainIDs[i].Name, s.clone, staging)
+		if err := cloneTree(parent, staging, s.clone); err != nil {
+			if s.clone == cloneReflinkOnly {
+				return 0, err
+			}
+			// applying all the layers is slower, but still works
+			util.Debugf("failed to clone %q: %s", parent, err)
+			return 0, os.RemoveAll(staging)
+		}
+		return i + 1, nil
+	}
+	return 0, nil
+}
+
+func (s *naiveSnapshotter) Remove(path string) error {
+	return removeChainID(path)
+}
+
+func (s *naiveSnapshotter) Mounts(path string, ref *Ref) (*Mount, error) {
+	// the chainID directory is used as it is, through the ref's rootfs link
+	return &Mount{Where: ref.RootFS()}, nil
+}
+
+// naiveActive is a chainID directory being populated in a staging directory
+// under the extracts "tmp" directory
+type naiveActive struct {
+	tmp, staging string
+	destpath     string
+}
+
+func (a *naiveActive) Apply(diffID *layout.DigestRef, apply func(dir string, opts LayerOptions) error) error {
+	return apply(a.staging, LayerOptions{})
+}
+
+// Commit atomically renames the staging directory to the chainID directory,
+// and marks it complete.
+func (a *naiveActive) Commit() error {
+	// the content must be on disk before the rename makes it visible
+	if err := syncfs(a.staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.destpath), os.FileMode(0755)); err != nil {
+		return err
+	}
+	if err := os.Rename(a.staging, a.destpath); err != nil {
+		return err
+	}
+	if err := markComplete(a.destpath); err != nil {
+		return err
+	}
+	return os.RemoveAll(a.tmp)
+}
+
+// Abort removes the staging directory, so a partially applied chainID is never
+// mistaken for a good one
+func (a *naiveActive) Abort() error {
+	return os.RemoveAll(a.tmp)
+}
+
+// markComplete writes the marker for the chainID directory at destpath
+func markComplete(destpath string) error {
+	fh, err := os.Create(destpath + completeSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(fh, filepath.Base(destpath)+"\n"); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(destpath))
+}
+
+// removeChainID removes a chainID directory and its marker. The marker is
+// removed first, so that an interrupted removal is not seen as complete.
+func removeChainID(destpath string) error {
+	if err := os.Remove(destpath + completeSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(destpath)
+}
+
+// CleanIncomplete removes what is left of extractions that did not finish:
+// the staging directories under "tmp", and chainID (and layer) directories
+// without their completion marker. The paths removed are returned. It holds the store lock
+// exclusive, so it waits for extractions in progress.
+//
+// A directory without its marker that an extracted ref (or one of its
+// generations) links to is kept, and marked complete instead. Refs are only
+// linked once extracted, so it is from before the markers were written, and
+// may be the rootfs of a running service.
+func CleanIncomplete(rootpath string) ([]string, error) {
+	storeLock, err := LockStore(rootpath, true)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+
+	removed := []string{}
+	tmpDir := filepath.Join(rootpath, nameTmp)
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(tmpDir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+
+	linked, err := linkedSnapshots(rootpath)
+	if err != nil {
+		return removed, err
+	}
+
+	// dirs/chainID/<hashName>/<shard>/<sum>, and the same for layers
+	for _, dir := range []string{nameChainIDDir, nameLayers} {
+		matches, err := filepath.Glob(filepath.Join(rootpath, dir, "*", "*", "*"))
+		if err != nil {
+			return removed, err
+		}
+		for _, path := range matches {
+			if strings.HasSuffix(path, completeSuffix) {
+				// a marker without its directory
+				if _, err := os.Stat(strings.TrimSuffix(path, completeSuffix)); err != nil && os.IsNotExist(err) {
+					if err := os.Remove(path); err != nil {
+						return removed, err
+					}
+					removed = append(removed, path)
+				}
+				continue
+			}
+			if chainIDComplete(path) {
+				continue
+			}
+			if linked[dir][pathDigest(path)] {
+				util.Debugf("%q is linked from a ref, but not marked complete. Adopting it.", path)
+				if err := markComplete(path); err != nil {
+					return removed, err
+				}
+				continue
+			}
+			util.Debugf("%q is incomplete. Removing.", path)
+			if err := removeChainID(path); err != nil {
+				return removed, err
+			}
+			removed = append(removed, path)
+		}
+	}
+	return removed, nil
+}
+
+// linkedSnapshots are the digests of the chainID directories (under
+// nameChainIDDir) and layers (under nameLayers) that the extracted refs at
+// rootpath, and their generations, link to
+func linkedSnapshots(rootpath string) (map[string]map[string]bool, error) {
+	linked := map[string]map[string]bool{nameChainIDDir: {}, nameLayers: {}}
+	extracts, err := WalkForExtracts(rootpath)
+	if err == ErrNoExtracts {
+		return linked, nil
+	} else if err != nil {
+		return nil, err
+	}
+	mark := func(path string) {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return
+		}
+		if lowers, err := readOverlayLayers(target); err == nil {
+			for _, lower := range lowers.Lower {
+				linked[nameLayers][pathDigest(lower)] = true
+			}
+			return
+		}
+		linked[nameChainIDDir][pathDigest(target)] = true
+	}
+	for _, el := range extracts {
+		refs, err := el.Refs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			mark(ref.RootFS())
+			gens, err := ref.Generations()
+			if err != nil {
+				return nil, err
+			}
+			for _, g := range gens {
+				mark(g.RootFS())
+			}
+		}
+	}
+	return linked, nil
+}
+
+func syncfs(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return unix.Syncfs(int(fh.Fd()))
+}
+
+func syncDir(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return fh.Sync()
+}
@@ -0,0 +1,225 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/vbatts/oci-systemd-generator/util"
+	"golang.org/x/sys/unix"
+)
+
+// CloneMode is how a parent chainID directory is cloned to apply the layers
+// on top of it.
+type CloneMode string
+
+const (
+	// CloneReflink shares the file data copy-on-write (FICLONE, as on btrfs and
+	// xfs), and copies where that is not supported.
+	CloneReflink CloneMode = "reflink"
+
+	// CloneHardlink hardlinks the files to the parent, and copies where that is
+	// not possible. Layers are applied by replacing files rather than writing
+	// to them, so the parent is not changed by extracting. But the files are
+	// shared, so a service writing to one in place changes it in every image
+	// sharing it.
+	CloneHardlink CloneMode = "hardlink"
+
+	// CloneCopy copies every file
+	CloneCopy CloneMode = "copy"
+
+	// CloneNone does not clone parent chainID directories, and applies every
+	// layer from the base up
+	CloneNone CloneMode = "none"
+
+	// cloneReflinkOnly is CloneReflink, but failing where reflinks are not
+	// supported, for StorageReflink
+	cloneReflinkOnly CloneMode = "reflink-only"
+)
+
+// DefaultCloneMode is how parent chainID directories are cloned by Extract
+var DefaultCloneMode = CloneReflink
+
+// ParseCloneMode checks that s is one of the CloneModes
+func ParseCloneMode(s string) (CloneMode, error) {
+	switch mode := CloneMode(s); mode {
+	case CloneReflink, CloneHardlink, CloneCopy, CloneNone:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown clone mode %q", s)
+}
+
+// cloneTree clones the directory tree of src to dest, which must not exist.
+// Ownership, modes, times and xattrs are kept, as are hardlinks within src.
+func cloneTree(src, dest string, mode CloneMode) error {
+	// inode of src to the path first cloned for it, for keeping hardlinks
+	inodes := map[uint64]string{}
+	dirs := []string{}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("%q: no stat_t", path)
+		}
+
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			// the mode and times are set after the entries in them are created
+			dirs = append(dirs, rel)
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+				util.Debugf("%q: failed to set owner: %s", target, err)
+			}
+			return nil
+		default:
+			if first, ok := inodes[st.Ino]; ok && st.Nlink > 1 {
+				return os.Link(first, target)
+			}
+			inodes[st.Ino] = target
+			if info.Mode().IsRegular() {
+				if mode == CloneHardlink {
+					if err := os.Link(path, target); err == nil {
+						// the inode, and so its metadata, is the parent's
+						return nil
+					}
+				}
+				if err := cloneFile(path, target, info.Mode().Perm(), mode); err != nil {
+					return err
+				}
+			} else {
+				// device nodes, fifos and sockets
+				if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+					return err
+				}
+			}
+		}
+		return cloneMetadata(path, target, info, st)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(src, dirs[i])
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if err := cloneMetadata(path, filepath.Join(dest, dirs[i]), info, info.Sys().(*syscall.Stat_t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneFile copies the regular file src to dest, sharing the data with a
+// reflink if mode is CloneReflink (or cloneReflinkOnly) and the filesystem
+// supports it.
+func cloneFile(src, dest string, perm os.FileMode, mode CloneMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if mode == CloneReflink || mode == cloneReflinkOnly {
+		err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+		if err == nil {
+			return out.Close()
+		}
+		if mode == cloneReflinkOnly {
+			out.Close()
+			return fmt.Errorf("%q: reflink: %s", src, err)
+		}
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// cloneMetadata sets the owner, mode, times and xattrs of dest to those of src
+func cloneMetadata(src, dest string, info os.FileInfo, st *syscall.Stat_t) error {
+	if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+		util.Debugf("%q: failed to set owner: %s", dest, err)
+	}
+	// after chown, which clears setuid and setgid
+	if err := os.Chmod(dest, info.Mode()); err != nil {
+		return err
+	}
+	if err := cloneXattrs(src, dest); err != nil {
+		util.Debugf("%q: failed to copy xattrs: %s", dest, err)
+	}
+	mtime := info.ModTime()
+	atime := time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	if err := os.Chtimes(dest, atime, mtime); err != nil {
+		util.Debugf("%q: failed to set times: %s", dest, err)
+	}
+	return nil
+}
+
+func cloneXattrs(src, dest string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size == 0 {
+		return err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return err
+	}
+	for _, name := range splitXattrNames(buf[:size]) {
+		vsize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(src, name, value)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dest, name, value[:vsize], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitXattrNames splits the NUL separated names from listxattr(2)
+func splitXattrNames(buf []byte) []string {
+	names := []string{}
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
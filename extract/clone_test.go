@@ -0,0 +1,159 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+// newImage writes an image of the uncompressed tar layers to the layout name
+// under root, and returns its manifest.
+func newImage(t *testing.T, root, name string, layers ...[]byte) *layout.Manifest {
+	blobs := filepath.Join(root, name, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	addBlob := func(mediaType string, buf []byte) v1.Descriptor {
+		sum := fmt.Sprintf("%x", sha256.Sum256(buf))
+		if err := ioutil.WriteFile(filepath.Join(blobs, sum), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return v1.Descriptor{MediaType: mediaType, Digest: "sha256:" + sum, Size: int64(len(buf))}
+	}
+	addJSON := func(mediaType string, v interface{}) v1.Descriptor {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addBlob(mediaType, buf)
+	}
+
+	manifest := v1.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}}
+	config := v1.Image{Architecture: "amd64", OS: "linux", RootFS: v1.RootFS{Type: "layers"}}
+	for _, layer := range layers {
+		desc := addBlob(layout.MediaTypeImageLayerTar, layer)
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, desc.Digest)
+	}
+	manifest.Config = addJSON(v1.MediaTypeImageConfig, config)
+	desc := addJSON(v1.MediaTypeImageManifest, manifest)
+
+	m, err := layout.ManifestFromDescriptor(&layout.Layout{Root: root, Name: name}, &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCloneTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-clone.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	// bin is kept writable when not root, to write bin/true in it
+	rootless, binMode := os.Geteuid() != 0, os.FileMode(0555)
+	if rootless {
+		binMode = 0755
+	}
+	if _, err := ApplyLayer(src, layout.MediaTypeImageLayerTar, bytes.NewReader(makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755}},
+		tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"},
+		tarEntry{hdr: tar.Header{Name: "etc/issue", Typeflag: tar.TypeLink, Linkname: "etc/motd"}},
+		tarEntry{hdr: tar.Header{Name: "etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"}},
+		tarEntry{hdr: tar.Header{Name: "bin", Typeflag: tar.TypeDir, Mode: 0555}},
+		tarEntry{hdr: tar.Header{Name: "bin/true", Mode: 0755}, body: "#!/bin/sh\n"},
+	)), LayerOptions{Rootless: rootless}); err != nil {
+		t.Fatal(err)
+	}
+
+	inode := func(path string) uint64 {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Ino
+	}
+	for _, mode := range []CloneMode{CloneReflink, CloneHardlink, CloneCopy} {
+		dest := filepath.Join(dir, string(mode))
+		if err := cloneTree(src, dest, mode); err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dest, "etc/motd"))
+		if err != nil || string(buf) != "slartibartfast\n" {
+			t.Errorf("%s: expected etc/motd to be cloned; got %q (%v)", mode, buf, err)
+		}
+		if link, err := os.Readlink(filepath.Join(dest, "etc/localtime")); err != nil || link != "/usr/share/zoneinfo/UTC" {
+			t.Errorf("%s: expected etc/localtime to be a symlink; got %q (%v)", mode, link, err)
+		}
+		if inode(filepath.Join(dest, "etc/motd")) != inode(filepath.Join(dest, "etc/issue")) {
+			t.Errorf("%s: expected etc/issue to still be a hardlink of etc/motd", mode)
+		}
+		sharesInode := inode(filepath.Join(dest, "etc/motd")) == inode(filepath.Join(src, "etc/motd"))
+		if sharesInode != (mode == CloneHardlink) {
+			t.Errorf("%s: expected sharing the inode with the source to be %t", mode, mode == CloneHardlink)
+		}
+		info, err := os.Stat(filepath.Join(dest, "bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != binMode {
+			t.Errorf("%s: expected bin to be mode %04o; got %s", mode, binMode, info.Mode())
+		}
+	}
+}
+
+func TestExtractClonesParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-clone-parent.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	base := makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"})
+	top := makeTar(t, tarEntry{hdr: tar.Header{Name: "bin/true", Mode: 0755}, body: "#!/bin/sh\n"})
+	parent := newImage(t, layouts, "example.com/base", base)
+	parent.Ref = "latest"
+	child := newImage(t, layouts, "example.com/app", base, top)
+	child.Ref = "latest"
+
+	el, err := Extract(extracts, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only in the parent's chainID dir, and so only in the child by cloning it
+	parentPath, err := os.Readlink(el.rootfsPath("latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(parentPath, "cloned"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	el, err = Extract(extracts, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/motd", "bin/true", "cloned"} {
+		if _, err := os.Stat(filepath.Join(el.rootfsPath("latest"), name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parentPath, "bin/true")); !os.IsNotExist(err) {
+		t.Errorf("expected the parent to be unchanged; got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package extract
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+// Decompressor wraps the stream of a layer blob, providing the tar stream of
+// the layer. The caller is responsible for closing the io.ReadCloser.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// Decompressors maps the layer media types that can be applied (as given by
+// layout.CanonicalMediaType) to the Decompressor for their stream.
+var Decompressors = map[string]Decompressor{
+	v1.MediaTypeImageLayer:                         GzipDecompressor,
+	v1.MediaTypeImageLayerNonDistributable:         GzipDecompressor,
+	layout.MediaTypeImageLayerTar:                  NoDecompressor,
+	layout.MediaTypeImageLayerNonDistributableTar:  NoDecompressor,
+	layout.MediaTypeImageLayerZstd:                 ZstdDecompressor,
+	layout.MediaTypeImageLayerNonDistributableZstd: ZstdDecompressor,
+}
+
+// GzipDecompressor is for "+gzip" layers
+func GzipDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// ZstdDecompressor is for "+zstd" layers. The decoder is single threaded, to
+// keep the memory use down on small devices.
+func ZstdDecompressor(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// NoDecompressor is for layers that are a plain tar stream
+func NoDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
@@ -0,0 +1,104 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+// tarEntry is a file for making a test layer with makeTar
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func makeTar(t *testing.T, entries ...tarEntry) []byte {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressors(t *testing.T) {
+	layer := makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"})
+
+	gzBuf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(gzBuf)
+	if _, err := gz.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zstdBuf := bytes.NewBuffer(nil)
+	zw, err := zstd.NewWriter(zstdBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for mediatype, blob := range map[string][]byte{
+		v1.MediaTypeImageLayer:         gzBuf.Bytes(),
+		layout.MediaTypeDockerLayer:    gzBuf.Bytes(),
+		layout.MediaTypeImageLayerTar:  layer,
+		layout.MediaTypeImageLayerZstd: zstdBuf.Bytes(),
+	} {
+		dir, err := ioutil.TempDir("", "test-apply.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := ApplyImageLayer(dir, mediatype, bytes.NewReader(blob)); err != nil {
+			t.Errorf("%s: %s", mediatype, err)
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "etc/motd"))
+		if err != nil {
+			t.Errorf("%s: %s", mediatype, err)
+			continue
+		}
+		if string(buf) != "slartibartfast\n" {
+			t.Errorf("%s: expected %q; got %q", mediatype, "slartibartfast\n", string(buf))
+		}
+	}
+
+	if err := ApplyImageLayer(os.TempDir(), "application/vnd.example.unknown", bytes.NewReader(layer)); err != layout.ErrUnsupportedMediaType {
+		t.Errorf("expected %q; got %v", layout.ErrUnsupportedMediaType, err)
+	}
+}
@@ -2,18 +2,17 @@ package extract
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 
-	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/vbatts/oci-systemd-generator/layout"
 	"github.com/vbatts/oci-systemd-generator/util"
+	"golang.org/x/sys/unix"
 )
 
 //var DefaultRootDir = RootDir{ Path: "/var/lib/oci" }
@@ -35,88 +34,95 @@ type RootDir struct {
 
 // Extract an OCI image manifest and its layers to the provided rootpath directory
 func Extract(rootpath string, m *layout.Manifest) (*Layout, error) {
+	result := ExtractWithResult(rootpath, m)
+	return result.Layout, result.Err
+}
+
+// ExtractWithResult is Extract, and also gives what of the image could not be
+// extracted as it has it: the metadata of its files that could not be applied,
+// and the device nodes not created (see LayerResult). Those are empty if the
+// image was already extracted.
+func ExtractWithResult(rootpath string, m *layout.Manifest) ExtractResult {
+	result := ExtractResult{Manifest: m, Metadata: []MetadataError{}, Devices: []Device{}}
+	result.Layout, result.Err = extractImage(rootpath, m, &result)
+	if result.Err != nil {
+		result.Layout = nil
+	}
+	return result
+}
+
+func extractImage(rootpath string, m *layout.Manifest, result *ExtractResult) (*Layout, error) {
 	// 1) mkdir for the layout name, and ref name
 	if m.Layout.Name == "" {
 		return nil, fmt.Errorf("image layout name cannot be empty")
 	}
+	if err := layout.ValidateRefName(m.Ref); err != nil {
+		return nil, err
+	}
 	el := Layout{
 		Root:     rootpath,
 		Name:     m.Layout.Name,
 		HashName: DefaultHashName,
 	}
-	_, err := os.Stat(filepath.Dir(el.refPath(m.Ref)))
+	storeLock, err := LockStore(rootpath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+	_, err = os.Stat(filepath.Dir(el.refPath(m.Ref)))
 	if err != nil && os.IsNotExist(err) {
 		if err := os.MkdirAll(filepath.Dir(el.refPath(m.Ref)), os.FileMode(0755)); err != nil {
 			return nil, fmt.Errorf("error preparing %s/%s: %s", el.Name, m.Ref, err)
 		}
 	}
-	// 2) copy over the manifest's config to nameConfigs dir
-	// This first ref is a descriptor to a manifest
-	configFH, err := m.ConfigReader()
+	// 2) apply the layers referenced to the chainID's snapshot (see Snapshotter)
+	// which will require marshalling the manifest to get the config object
+	config, err := m.Config()
 	if err != nil {
 		return nil, err
 	}
-	if err := el.SetRefConfig(m.Ref, configFH); err != nil && err != os.ErrExist {
+	snapshotter, ok := Snapshotters[DefaultStorage]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage %q", DefaultStorage)
+	}
+	destpath, err := el.extractSnapshot(snapshotter(el), m, config, IDMaps[el.Name], result)
+	if err != nil {
 		return nil, err
 	}
-	configFH.Close()
-
-	// 3) apply the layers referenced to the layer's chanID dir
-	// which will require marshalling the manifest to get the config object
 
-	config, err := m.Config()
+	// 3) copy over the manifest's config to nameConfigs dir
+	configFH, err := m.ConfigReader()
 	if err != nil {
 		return nil, err
 	}
-	chainIDRef, err := config.ChainID()
+	defer configFH.Close()
+	configPath, err := el.storeConfig(configFH)
 	if err != nil {
 		return nil, err
 	}
-	destpath := el.chainIDPath(chainIDRef.HashName(), chainIDRef.Sum())
-	if _, err := os.Stat(destpath); err != nil && os.IsNotExist(err) {
-		if err := os.MkdirAll(destpath, os.FileMode(0755)); err != nil {
-			return nil, fmt.Errorf("error preparing chainID dir for %s/%s: %s", chainIDRef.HashName(), chainIDRef.Sum(), err)
-		}
-		// ugh, here we'll have to access the objects in order from the manifest, but
-		// only when they're the right media type.
-		// also, for correctness, they'll have to cross-reference the checksum of each
-		// _uncompressed_ layer against the m.Layout.ImageConfig.RootFS.DiffIDs
-		// XXX
-		for _, desc := range m.Manifest.Layers {
-			err := func() error {
-				brdr, err := m.Layout.GetBlob(layout.DigestRef{Name: desc.Digest, Layout: m.Layout})
-				if err != nil {
-					return err
-				}
-				defer brdr.Close()
-
-				util.Debugf("Applying %q to chainID %q", desc.Digest, chainIDRef.Name)
-				err = ApplyImageLayer(destpath, desc.MediaType, brdr)
-				if err != nil && err == layout.ErrUnsupportedMediaType {
-					util.Debugf("%q is unsupported. Skipping...", desc.MediaType)
-				} else if err != nil {
-					if err == ErrPathEscapes {
-						util.Debugf(" removing %q", destpath)
-						os.RemoveAll(destpath)
-					}
-					return err
-				}
-
-				return nil
-			}()
-			if err != nil {
-				return nil, err
-			}
-		}
-	} else {
-		util.Debugf("chainID %q already exists. Not applying.", chainIDRef.Name)
-	}
 
-	// 4) symlink to that chainID dir
-	if _, err := os.Lstat(el.chainIDPath(chainIDRef.HashName(), chainIDRef.Sum())); err != nil && os.IsNotExist(err) {
-		if err := os.Symlink(el.chainIDPath(chainIDRef.HashName(), chainIDRef.Sum()), el.rootfsPath(m.Ref)); err != nil {
-			return nil, err
-		}
+	// 4) record this as a new generation of the ref, and link the ref to it. If
+	// the ref moved to a new image, the links are swapped to the new chainID
+	// dir and config.
+	var manifestDigest string
+	if m.Descriptor != nil {
+		manifestDigest = m.Descriptor.Digest
+	}
+	refLock, err := el.lockRef(m.Ref)
+	if err != nil {
+		return nil, err
+	}
+	defer refLock.Unlock()
+	if el.upToDate(m.Ref, configPath, destpath) {
+		// another process extracted it while this one waited
+		return &el, nil
+	}
+	g, err := el.addGeneration(m.Ref, manifestDigest, configPath, destpath)
+	if err != nil {
+		return nil, err
+	}
+	if err := el.setCurrent(g); err != nil {
+		return nil, err
 	}
 	return &el, nil
 }
@@ -138,33 +144,124 @@ func populateRootDir(rootpath string, perm os.FileMode) error {
 }
 
 // ApplyImageLayer extracts the typed stream to destpath.
+// The stream is decompressed by the Decompressor for its media type.
 // For OCI image layer, this means accommodating the whiteout file entries as well.
+// Entries are only ever created within destpath: symlinks are followed as if
+// destpath were the root, and entries leading out of it are skipped.
 // When applying uid/gid, it will attempt to chown the file if EPERM will default to current uid/gid.
 func ApplyImageLayer(destpath string, mediatype string, r io.Reader) error {
-	if mediatype != v1.MediaTypeImageLayer && mediatype != v1.MediaTypeImageLayerNonDistributable {
-		return layout.ErrUnsupportedMediaType
+	_, err := ApplyLayer(destpath, mediatype, r, LayerOptions{})
+	return err
+}
+
+// StrictMetadata is LayerOptions.StrictMetadata for the layers applied by
+// Extract
+var StrictMetadata = false
+
+// LayerOptions are the settings for applying a layer with ApplyLayer
+type LayerOptions struct {
+	// DiffID is the expected digest of the uncompressed layer (from the image
+	// config's rootfs.diff_ids). If set, a layer that does not hash to it
+	// returns ErrDiffIDMismatch.
+	DiffID string
+
+	// StrictMetadata fails the layer with the first MetadataError, rather than
+	// listing them in LayerResult.Metadata, for a rootfs that is exactly as the
+	// image has it.
+	StrictMetadata bool
+
+	// Rootless is for applying layers without being root. Files are owned by
+	// the user applying them, and their owner in the layer is recorded in the
+	// "user.rootlesscontainers" xattr instead (see RootlessOwner). Device nodes
+	// are not created, but listed in LayerResult.Devices with an empty file in
+	// their place (see RootlessDevice), and directories are kept writable by
+	// their owner, with the mode of the image recorded (see RootlessMode).
+	Rootless bool
+
+	// IDMap shifts the owner of each entry, for a rootfs used in a user
+	// namespace. An owner without a mapping is shifted to 65534 (nobody), and
+	// listed in LayerResult.Metadata.
+	IDMap *IDMap
+
+	// Overlay is for a layer stored on its own, as an overlayfs lowerdir.
+	// Whiteouts are translated to overlayfs whiteouts (a 0/0 character device,
+	// or the "trusted.overlay.opaque" xattr on an opaque directory) instead of
+	// removing what they white out.
+	Overlay bool
+}
+
+// LayerResult is the outcome of a layer applied with ApplyLayer
+type LayerResult struct {
+	DiffID    string   // digest of the uncompressed layer that was applied
+	Files     int      // count of the entries extracted
+	Whiteouts []string // whiteout entries encountered
+
+	// Metadata that could not be applied (like the owner, when not root)
+	Metadata []MetadataError
+
+	// Devices are the device nodes not created, for LayerOptions.Rootless
+	Devices []Device
+}
+
+// ErrDiffIDMismatch is when the uncompressed layer stream does not hash to
+// the expected diff_id.
+var ErrDiffIDMismatch = errors.New("layer does not match diff_id")
+
+// ApplyLayer is ApplyImageLayer, with options. The uncompressed stream is
+// hashed as it is applied, and checked against opts.DiffID (if set). On
+// error, destpath may be partially populated and it is for the caller to
+// clean up.
+func ApplyLayer(destpath string, mediatype string, r io.Reader, opts LayerOptions) (*LayerResult, error) {
+	decompress, ok := Decompressors[layout.CanonicalMediaType(mediatype)]
+	if !ok {
+		return nil, layout.ErrUnsupportedMediaType
+	}
+
+	hashName := DefaultHashName
+	if opts.DiffID != "" {
+		expected := layout.DigestRef{Name: opts.DiffID}
+		if err := expected.Validate(); err != nil {
+			return nil, fmt.Errorf("diff_id %q: %s", opts.DiffID, err)
+		}
+		hashName = expected.HashName()
+	}
+	hash, ok := util.HashMap[hashName]
+	if !ok {
+		return nil, util.ErrNoHash
 	}
+	h := hash.New()
 
 	// for good measure
 	destpath = filepath.Clean(destpath)
+	if err := os.MkdirAll(destpath, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	// every entry is created through root, so never outside of destpath
+	root, err := openRoot(destpath)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
 
-	// Both of the above checked mediatypes are gzip compressed.
-	gz, err := gzip.NewReader(r)
+	dr, err := decompress(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer gz.Close()
-	// gz is now the tar stream
-	tr := tar.NewReader(gz)
+	defer dr.Close()
+	// dr is now the tar stream, and it is checksummed as it is read
+	tee := io.TeeReader(dr, h)
+	tr := tar.NewReader(tee)
 
+	result := &LayerResult{}
 	whiteouts := []string{}
-	filepaths := map[string]interface{}{}
+	paths := newLayerPaths()
+	dirs := []*tar.Header{}
 	for {
 		hdr, err := tr.Next()
 		if err != nil && err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return nil, err
 		}
 		hdr.Name = filepath.Clean(hdr.Name)
 		if escapedPath(destpath, hdr.Name) {
@@ -172,154 +269,260 @@ func ApplyImageLayer(destpath string, mediatype string, r io.Reader) error {
 			//return ErrPathEscapes
 			continue
 		}
-		if hdr.Linkname != "" {
-			linkpath := filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)
-			if escapedPath(destpath, linkpath) {
-				util.Debugf("%q -> %q attempts to escape %q!!", hdr.Name, hdr.Linkname, destpath)
-				//return ErrPathEscapes
-
-				// TODO experiment with this idea?
-				//hdr.Linkname = "/dev/null"
-				//hdr.Typeflag = tar.TypeSymlink
-				// XXX this is not right. It can chmod /dev/null on the host?
-				continue
-			}
-		}
 		if strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix) {
-			whiteouts = append(whiteouts, hdr.Name)
-			// delete all at the whiteout path _except_ the filepaths that have
-			// been extracted so far.
-			pathToDelete := pathFromWhiteout(hdr.Name)
-			if pathToDelete == "" {
-				continue
-			}
-			err := filepath.Walk(filepath.Join(destpath, pathToDelete), func(p string, info os.FileInfo, err error) error {
-				if err != nil {
-					if os.IsNotExist(err) {
-						return nil
-					}
-					return err
-				}
-				if _, exists := filepaths[p]; !exists {
-					if err := os.RemoveAll(p); err != nil && !os.IsNotExist(err) {
-						return err
-					}
-					//fmt.Printf("DELETE %q\n", p)
-				}
-				return nil
-			})
-			if err != nil {
-				return err
+			if err := checkWhiteout(hdr.Name); err != nil {
+				return nil, err
 			}
+			// applied to the lower layers once this layer's entries are
+			whiteouts = append(whiteouts, hdr.Name)
+			continue
+		}
 
+		if err := root.applyEntry(hdr, tr, opts, result); err == ErrPathEscapes {
+			util.Debugf("%q attempts to escape %q through a symlink!! Skipping", hdr.Name, destpath)
 			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if opts.StrictMetadata && len(result.Metadata) > 0 {
+			return result, result.Metadata[0]
+		}
+		paths.add(hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+	for _, name := range whiteouts {
+		if opts.Overlay {
+			err = root.overlayWhiteout(name, paths)
+		} else {
+			err = root.removeWhiteout(name, paths)
+		}
+		if err == ErrPathEscapes {
+			util.Debugf("%q attempts to escape %q!! Skipping", name, destpath)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	// once nothing more is created in them
+	root.setDirTimes(dirs, result)
+	if opts.StrictMetadata && len(result.Metadata) > 0 {
+		return result, result.Metadata[0]
+	}
+	util.Debugf("  extracted %d files", len(paths.written))
+	if len(whiteouts) > 0 {
+		util.Debugf("   whiteouts: %q", whiteouts)
+	}
+	for _, merr := range result.Metadata {
+		util.Debugf("   %s", merr)
+	}
+	if len(result.Devices) > 0 {
+		util.Debugf("   device nodes skipped: %s", result.Devices)
+	}
+
+	// the tar reader stops at the end-of-archive marker, but the diff_id
+	// covers the padding after it too.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, err
+	}
+	result.DiffID = fmt.Sprintf("%s:%x", hashName, h.Sum(nil))
+	result.Files = len(paths.written)
+	result.Whiteouts = whiteouts
+	if opts.DiffID != "" && result.DiffID != opts.DiffID {
+		util.Debugf("  expected diff_id %q; got %q", opts.DiffID, result.DiffID)
+		return result, ErrDiffIDMismatch
+	}
+	return result, nil
+}
+
+// applyEntry creates the entry of hdr in the root, reading the content of a
+// regular file from rd. What is already at its path is replaced rather than
+// written through, as it may be a symlink or a hardlink to a lower layer's file.
+// Metadata that could not be applied is added to result. A directory's times
+// are not set, as its entries are still to be created (see setDirTimes).
+func (r *rootDir) applyEntry(hdr *tar.Header, rd io.Reader, opts LayerOptions, result *LayerResult) error {
+	dirfd, name, err := r.openParent(hdr.Name, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	entrypath := filepath.Join(r.path, hdr.Name)
+	failed := func(op string, err error) {
+		result.Metadata = append(result.Metadata, MetadataError{Path: hdr.Name, Op: op, Err: err})
+	}
+	if opts.IDMap != nil {
+		if hdr.Uid, hdr.Gid, err = opts.IDMap.shift(hdr.Uid, hdr.Gid); err != nil {
+			failed("idmap", err)
 		}
+	}
 
-		// First ensure that the directory of this entry exists
-		dirpath := filepath.Join(destpath, filepath.Dir(hdr.Name))
-		if _, err := os.Lstat(dirpath); err != nil && os.IsNotExist(err) {
-			// Assuming a default mode. When/if this directories entry is encountered, we'll chmod it.
-			if err := os.MkdirAll(dirpath, os.FileMode(0755)); err != nil {
-				return err
-			}
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+		if hdr.Typeflag == tar.TypeDir && isDir {
+			// only its metadata is set
+		} else if err := removeAt(dirfd, name, isDir); err != nil {
+			return &os.PathError{Op: "remove", Path: entrypath, Err: err}
 		}
-		entrypath := filepath.Join(destpath, hdr.Name)
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if _, err := os.Lstat(entrypath); err != nil && os.IsNotExist(err) {
-				// Assuming a default mode. When/if this directories entry is encountered, we'll chmod it.
-				if err := os.MkdirAll(entrypath, os.FileMode(hdr.Mode)); err != nil {
-					// should fail
-					return err
-				}
-			}
-		case tar.TypeFifo:
-			if err := os.Remove(entrypath); err != nil && !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "failed to remove %q\n", entrypath)
-			}
-			if syscall.Mkfifo(entrypath, uint32(hdr.Mode)); err != nil {
-				// should fail
-				return err
-			}
-		case tar.TypeChar:
-			if err := os.Remove(entrypath); err != nil && !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "failed to remove %q\n", entrypath)
-			}
-			// should not fail
-			if err := syscall.Mknod(entrypath, syscall.S_IFCHR, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
-				fmt.Fprintf(os.Stderr, "%q failed to mknod: %s\n", entrypath, err)
-			}
-		case tar.TypeBlock:
-			if err := os.Remove(entrypath); err != nil && !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "failed to remove %q\n", entrypath)
-			}
-			// should not fail
-			if err := syscall.Mknod(entrypath, syscall.S_IFBLK, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
-				fmt.Fprintf(os.Stderr, "%q failed to mknod: %s\n", entrypath, err)
-			}
-		case tar.TypeSymlink:
-			if err := os.Remove(entrypath); err != nil && !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "failed to remove %q\n", entrypath)
-			}
-			// should fail?
-			if err := os.Symlink(hdr.Linkname, entrypath); err != nil {
-				fmt.Fprintf(os.Stderr, "INFO: failed to symlink to %q: %s\n", hdr.Linkname, err)
-			}
-		case tar.TypeLink:
-			if err := os.Remove(entrypath); err != nil && !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "failed to remove %q\n", entrypath)
-			}
-			// should fail? or should just copy from the original?
-			if err := os.Link(filepath.Join(destpath, hdr.Linkname), entrypath); err != nil {
-				fmt.Fprintf(os.Stderr, "INFO: failed to link to %q: %s\n", hdr.Linkname, err)
-			}
-		case tar.TypeReg:
-			if err := os.Remove(entrypath); err != nil && !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "failed to remove %q\n", entrypath)
-			}
-			fh, err := os.Create(entrypath)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// Assuming a default mode. When/if this directories entry is encountered, we'll chmod it.
+		mode := uint32(hdr.Mode) & 07777
+		if opts.Rootless {
+			// the user.rootlesscontainers xattr is only set on what is writable
+			mode |= 0700
+		}
+		if err := unix.Mkdirat(dirfd, name, mode); err != nil && err != unix.EEXIST {
+			// should fail
+			return &os.PathError{Op: "mkdir", Path: entrypath, Err: err}
+		}
+	case tar.TypeFifo:
+		if err := unix.Mknodat(dirfd, name, unix.S_IFIFO|uint32(hdr.Mode)&07777, 0); err != nil {
+			// should fail
+			return &os.PathError{Op: "mkfifo", Path: entrypath, Err: err}
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if opts.Rootless {
+			// device nodes can only be made by root, so an empty file marks it
+			dev := Device{Path: hdr.Name, Type: hdr.Typeflag, Major: hdr.Devmajor, Minor: hdr.Devminor}
+			fd, err := unix.Openat(dirfd, name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
 			if err != nil {
-				return err
+				return &os.PathError{Op: "create", Path: entrypath, Err: err}
 			}
-			if _, err := io.Copy(fh, tr); err != nil {
-				fh.Close()
-				return err
+			unix.Close(fd)
+			if err := unix.Lsetxattr(fdPath(dirfd, name), rootlessDeviceXattr, []byte(dev.xattr()), 0); err != nil {
+				failed("setxattr "+rootlessDeviceXattr, err)
 			}
+			result.Devices = append(result.Devices, dev)
+			break
+		}
+		devType := uint32(unix.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			devType = unix.S_IFBLK
+		}
+		// should not fail
+		if err := unix.Mknodat(dirfd, name, devType, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			failed("mknod", err)
+		}
+	case tar.TypeSymlink:
+		// should fail?
+		if err := unix.Symlinkat(hdr.Linkname, dirfd, name); err != nil {
+			failed("symlink", err)
+		}
+	case tar.TypeLink:
+		// the target is resolved in the root the same as the entry, and is not
+		// followed if it is a symlink itself
+		targetfd, target, err := r.openParent(hdr.Linkname, false)
+		if err == nil {
+			err = unix.Linkat(targetfd, target, dirfd, name, 0)
+			unix.Close(targetfd)
+		}
+		// should fail? or should just copy from the original?
+		if err != nil {
+			failed("link", err)
+		}
+	case tar.TypeReg, tar.TypeGNUSparse:
+		fd, err := unix.Openat(dirfd, name, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err != nil {
+			return &os.PathError{Op: "create", Path: entrypath, Err: err}
+		}
+		fh := os.NewFile(uintptr(fd), entrypath)
+		if isSparse(hdr) {
+			err = copySparse(fh, rd, hdr.Size)
+		} else {
+			_, err = io.Copy(fh, rd)
+		}
+		if err != nil {
 			fh.Close()
-		default:
-			util.Debugf("unknown tar type: %q", hdr.Typeflag)
-		}
-		// these are generic for all types except symlinks
-		// most of these ought not be fatal, but log to stderr
-		if info, err := os.Lstat(entrypath); err == nil && info.Mode()&os.ModeSymlink == 0 {
-			if err := os.Chmod(entrypath, os.FileMode(hdr.Mode)); err != nil {
-				fmt.Fprintf(os.Stderr, "INFO: failed to set mode: %s\n", err)
-			}
-			if err := os.Chown(entrypath, hdr.Uid, hdr.Gid); err != nil {
-				fmt.Fprintf(os.Stderr, "INFO: failed to set owner: %s\n", err)
-			}
-			if err := os.Chtimes(entrypath, hdr.ModTime, hdr.ModTime); err != nil {
-				fmt.Fprintf(os.Stderr, "INFO: failed to set times: %s\n", err)
+			return err
+		}
+		fh.Close()
+	default:
+		util.Debugf("unknown tar type: %q", hdr.Typeflag)
+	}
+
+	// hardlinks share the inode of what they link to (possibly of a lower
+	// layer), which has its own metadata
+	if hdr.Typeflag == tar.TypeLink {
+		return nil
+	}
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil
+	}
+	isLink := st.Mode&unix.S_IFMT == unix.S_IFLNK
+	if !opts.Rootless {
+		if err := unix.Fchownat(dirfd, name, hdr.Uid, hdr.Gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			failed("chown", err)
+		}
+	} else if !isLink {
+		// user xattrs can not be set on symlinks
+		if err := setRootlessOwner(dirfd, name, hdr.Uid, hdr.Gid); err != nil {
+			failed("setxattr "+rootlessXattr, err)
+		}
+	}
+	if !isLink {
+		mode := uint32(hdr.Mode) & 07777
+		if opts.Rootless && hdr.Typeflag == tar.TypeDir {
+			// kept writable, for the entries of later layers and to remove it
+			if err := setRootlessMode(dirfd, name, mode, mode|0700); err != nil {
+				failed("setxattr "+rootlessModeXattr, err)
 			}
-			for k, v := range hdr.Xattrs {
-				if err := syscall.Setxattr(entrypath, k, []byte(v), 0); err != nil {
-					fmt.Fprintf(os.Stderr, "%q failed to set xattr %q: %s\n", entrypath, k, err)
-				}
+			mode |= 0700
+		}
+		// after chown, which clears setuid and setgid (and file capabilities, so
+		// those xattrs are set after it too). It is not a symlink, so there is
+		// nothing for fchmodat to follow.
+		if err := unix.Fchmodat(dirfd, name, mode, 0); err != nil {
+			failed("chmod", err)
+		}
+		for k, v := range entryXattrs(hdr) {
+			if err := unix.Lsetxattr(fdPath(dirfd, name), k, []byte(v), 0); err != nil {
+				failed("setxattr "+k, err)
 			}
 		}
-
-		// whiteouts. I hate them. Since they are not ordered, and technically
-		// apply to "lower layers", then effective they must be applied first,
-		// regardless of when in this stream they show up.
-		filepaths[hdr.Name] = nil
 	}
-	util.Debugf("  extracted %d files", len(filepaths))
-	if len(whiteouts) > 0 {
-		util.Debugf("   whiteouts: %q", whiteouts)
+	if hdr.Typeflag != tar.TypeDir {
+		ts := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+		if err := unix.UtimesNanoAt(dirfd, name, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			failed("chtimes", err)
+		}
 	}
 	return nil
 }
 
+// removeAt removes the entry name of dirfd, and if it is a directory,
+// everything under it. Nothing under it is followed if it is a symlink.
+func removeAt(dirfd int, name string, isDir bool) error {
+	if !isDir {
+		return unix.Unlinkat(dirfd, name, 0)
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		dir.Close()
+		return err
+	}
+	for _, child := range names {
+		var st unix.Stat_t
+		if err := unix.Fstatat(fd, child, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			dir.Close()
+			return err
+		}
+		if err := removeAt(fd, child, st.Mode&unix.S_IFMT == unix.S_IFDIR); err != nil {
+			dir.Close()
+			return err
+		}
+	}
+	dir.Close()
+	return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
+
 func mkdev(major, minor int64) int {
 	return int(uint32(((minor & 0xfff00) << 12) | ((major & 0xfff) << 8) | (minor & 0xff)))
 }
@@ -340,6 +543,25 @@ func pathFromWhiteout(path string) string {
 	return filepath.Join(filepath.Dir(path), strings.TrimPrefix(filepath.Base(path), whiteoutPrefix))
 }
 
+// ErrInvalidWhiteout is when a whiteout entry does not name an entry of its
+// directory (like `.wh..`), which would white out the directory itself or its
+// parent
+var ErrInvalidWhiteout = errors.New("whiteout does not name an entry")
+
+// checkWhiteout checks that the whiteout entry path names what it whites out
+func checkWhiteout(path string) error {
+	base := filepath.Base(path)
+	if strings.HasPrefix(base, whiteoutPrefix+whiteoutPrefix) {
+		// opaque, or the aufs metadata that is skipped
+		return nil
+	}
+	switch name := strings.TrimPrefix(base, whiteoutPrefix); {
+	case name == "", name == ".", name == "..", strings.Contains(name, "/"):
+		return &os.PathError{Op: "whiteout", Path: path, Err: ErrInvalidWhiteout}
+	}
+	return nil
+}
+
 // ErrPathEscapes is when a path in an archive is attempting to escape the destination path
 var ErrPathEscapes = errors.New("path in archive attempts to escape root")
 
@@ -1,10 +1,16 @@
 package extract
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
 )
 
 func TestRootDir(t *testing.T) {
@@ -26,3 +32,472 @@ func TestRootDir(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestApplyLayerDiffID(t *testing.T) {
+	layer := makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"})
+	expected := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+
+	dir, err := ioutil.TempDir("", "test-diffid.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	result, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(layer), LayerOptions{DiffID: expected})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DiffID != expected {
+		t.Errorf("expected %q; got %q", expected, result.DiffID)
+	}
+
+	bogus := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	_, err = ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(layer), LayerOptions{DiffID: bogus})
+	if err != ErrDiffIDMismatch {
+		t.Errorf("expected %q; got %v", ErrDiffIDMismatch, err)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	layouts, err := layout.WalkForLayouts("../testdata/layouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := layouts["tianon/true"]
+	desc, err := l.GetRef("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := layout.ManifestFromDescriptor(l, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Ref = "latest"
+
+	dir, err := ioutil.TempDir("", "test-extract.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	el, err := Extract(dir, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stored by its chainID, keyed the same as Extract does (see snapshotKey)
+	chainID, err := snapshotKey(&layout.DigestRef{Name: "sha256:3342106d17cf8fc913c462a27e792c09780fac1a34075098f8180398294c976a"}, nil, Rootless)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destpath, err := el.chainIDPath(chainID.HashName(), chainID.Sum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(destpath, "true")); err != nil {
+		t.Error(err)
+	}
+	if !chainIDComplete(destpath) {
+		t.Errorf("expected %q to be marked complete", destpath)
+	}
+	if _, err := os.Stat(filepath.Join(el.rootfsPath("latest"), "true")); err != nil {
+		t.Error(err)
+	}
+
+	extracts, err := WalkForExtracts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extracts) != 1 || extracts[0].Name != "tianon/true" {
+		t.Fatalf("expected to find the extracted tianon/true; got %v", extracts)
+	}
+	ne, err := DetermineNotExtracted(extracts, []*layout.Manifest{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ne) != 0 {
+		t.Errorf("expected nothing to be extracted; got %d", len(ne))
+	}
+
+	// the ref moving to another config needs it extracted again
+	moved := *m
+	movedManifest := *m.Manifest
+	movedManifest.Config.Digest = "sha256:8fe85f31aa6fa5ff4e5cb7d03497e9a78c0f8492ec2da21279adedbc312976cf"
+	moved.Manifest = &movedManifest
+	ne, err = DetermineNotExtracted(extracts, []*layout.Manifest{&moved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ne) != 1 {
+		t.Errorf("expected the moved ref to be extracted; got %d", len(ne))
+	}
+}
+
+func TestShardedPaths(t *testing.T) {
+	el := Layout{Root: "/var/lib/oci/extracts", Name: "example.com/myapp", HashName: "sha512"}
+	sum := "ab0979ff5659e0aa3c3ebe572330da179c5a11a7434ffb7d57ff5cb9e2c2f51e74551ab62bde678b89f31a35fc7c9455645a2b2d7cd9151123c71aebbbcfdbb2"
+	got, err := el.configPath("sha512", sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := filepath.Join("/var/lib/oci/extracts/configs/sha512/ab", sum)
+	if got != expect {
+		t.Errorf("expected %q; got %q", expect, got)
+	}
+
+	for _, bad := range []string{"", "a", "../../../../etc", sum[:64]} {
+		if got, err := el.chainIDPath("sha512", bad); err == nil {
+			t.Errorf("expected an error for %q; got %q", bad, got)
+		}
+	}
+}
+
+func TestRefPaths(t *testing.T) {
+	el := Layout{Root: "/var/lib/oci/extracts", Name: "example.com/myapp", HashName: DefaultHashName}
+	for ref, expect := range map[string]string{
+		"stable":             "stable",
+		"v1/beta":            "v1%2Fbeta",
+		"100%":               "100%25",
+		"../../../../escape": "%2E.%2F..%2F..%2F..%2Fescape",
+		"..":                 "%2E.",
+		".":                  "%2E",
+		"":                   "%",
+	} {
+		got := el.refPath(ref)
+		if got != filepath.Join(el.Root, nameNames, el.Name, expect, nameRef) {
+			t.Errorf("%q: expected it under %q; got %q", ref, expect, got)
+		}
+		if back := unescapeRef(escapeRef(ref)); back != ref {
+			t.Errorf("%q: expected to unescape to itself; got %q", ref, back)
+		}
+	}
+}
+
+func TestExtractRefWithSlash(t *testing.T) {
+	// the tianon/true layout, with its image as ref "v1/beta"
+	layoutsDir, err := ioutil.TempDir("", "test-layouts.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(layoutsDir)
+	src := "../testdata/layouts/tianon/true"
+	dest := filepath.Join(layoutsDir, "tianon/true")
+	for _, sub := range []string{"refs/v1", "blobs/sha256"} {
+		if err := os.MkdirAll(filepath.Join(dest, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copies := map[string]string{"oci-layout": "oci-layout", "refs/latest": "refs/v1/beta"}
+	blobs, err := ioutil.ReadDir(filepath.Join(src, "blobs/sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		copies[filepath.Join("blobs/sha256", blob.Name())] = filepath.Join("blobs/sha256", blob.Name())
+	}
+	for from, to := range copies {
+		buf, err := ioutil.ReadFile(filepath.Join(src, from))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dest, to), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layouts, err := layout.WalkForLayouts(layoutsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := layouts["tianon/true"]
+	desc, err := l.GetRef("v1/beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := layout.ManifestFromDescriptor(l, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Ref = "v1/beta"
+
+	dir, err := ioutil.TempDir("", "test-extract.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := Extract(dir, m); err != nil {
+		t.Fatal(err)
+	}
+
+	extracts, err := WalkForExtracts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extracts) != 1 || extracts[0].Name != "tianon/true" {
+		t.Fatalf("expected to find the extracted tianon/true; got %v", extracts)
+	}
+	refs, err := extracts[0].Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Name != "v1/beta" {
+		t.Fatalf("expected ref %q; got %v", "v1/beta", refs)
+	}
+	if refs[0].Orphaned(layouts) {
+		t.Errorf("expected %q to not be orphaned", refs[0].Name)
+	}
+	if _, err := os.Stat(filepath.Join(refs[0].RootFS(), "true")); err != nil {
+		t.Error(err)
+	}
+	if got := refs[0].ReverseDomainNotation(); got != "tianon.true.ref.v1.beta" {
+		t.Errorf("expected %q; got %q", "tianon.true.ref.v1.beta", got)
+	}
+	ne, err := DetermineNotExtracted(extracts, []*layout.Manifest{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ne) != 0 {
+		t.Errorf("expected nothing to be extracted; got %d", len(ne))
+	}
+
+	m.Ref = "../../escape"
+	if _, err := Extract(dir, m); err == nil {
+		t.Error("expected a ref name that is not valid to fail")
+	}
+}
+
+func TestExtractCorruptLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-corrupt.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	m := newImage(t, layouts, "example.com/app",
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"}))
+	m.Ref = "latest"
+	// of the same size, so that only hashing it finds it
+	layer := m.Manifest.Layers[0]
+	corrupt := makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "zaphodbeeblebr\n"})
+	if err := ioutil.WriteFile(filepath.Join(layouts, m.Layout.Name, "blobs", "sha256", layer.Digest[len("sha256:"):]), corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if invalid, err := m.MissingBlobs(); err != nil || len(invalid) != 0 {
+		t.Fatalf("expected the layer to be there; got %v (%v)", invalid, err)
+	}
+
+	// it is caught as it is extracted
+	if _, err := Extract(extracts, m); err == nil {
+		t.Fatal("expected the corrupt layer to fail extraction")
+	}
+	el := Layout{Root: extracts, Name: m.Layout.Name}
+	if _, err := os.Lstat((Ref{Name: "latest", Layout: &el}).RootFS()); !os.IsNotExist(err) {
+		t.Errorf("expected no rootfs; got %v", err)
+	}
+}
+
+func TestExtractUnsupportedLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-unsupported.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	m := newImage(t, layouts, "example.com/app",
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"}),
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "bin/true"}, body: "#!/bin/sh\n"}))
+	m.Ref = "latest"
+	m.Manifest.Layers[1].MediaType = "application/vnd.example.unknown"
+
+	// rather than a rootfs without that layer
+	if _, err := Extract(extracts, m); err != layout.ErrUnsupportedMediaType {
+		t.Fatalf("expected %q; got %v", layout.ErrUnsupportedMediaType, err)
+	}
+	el := Layout{Root: extracts, Name: m.Layout.Name}
+	if _, err := os.Lstat((Ref{Name: "latest", Layout: &el}).RootFS()); !os.IsNotExist(err) {
+		t.Errorf("expected no rootfs; got %v", err)
+	}
+	complete, err := filepath.Glob(filepath.Join(extracts, nameChainIDDir, "*", "*", "*"+completeSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(complete) != 0 {
+		t.Errorf("expected no complete chainIDs; got %q", complete)
+	}
+}
+
+func TestExtractAllMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-metadata.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	m := newImage(t, layouts, "example.com/app",
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "home/user/.profile", Uid: 5000}, body: "\n"}))
+	m.Ref = "latest"
+	idmap, err := ParseIDMap("0:100000:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	IDMaps[m.Layout.Name] = idmap
+	defer delete(IDMaps, m.Layout.Name)
+
+	results := ExtractAll(extracts, []*layout.Manifest{m}, 1)
+	if results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	if len(results[0].Metadata) != 1 || results[0].Metadata[0].Path != "home/user/.profile" || results[0].Metadata[0].Op != "idmap" {
+		t.Errorf("expected the unmapped owner of home/user/.profile; got %v", results[0].Metadata)
+	}
+}
+
+func TestCleanIncomplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-clean.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	el := Layout{Root: dir, Name: "example.com/myapp", HashName: DefaultHashName}
+
+	complete, err := el.chainIDPath("sha256", "3342106d17cf8fc913c462a27e792c09780fac1a34075098f8180398294c976a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incomplete, err := el.chainIDPath("sha256", "26ab43e7d8f84043e608d1be92d9918a8aa6860489b6f221f29bc49d0081c3c3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{complete, incomplete} {
+		if err := os.MkdirAll(filepath.Join(path, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := markComplete(complete); err != nil {
+		t.Fatal(err)
+	}
+	staging, err := el.tmpPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := CleanIncomplete(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("expected the staging and incomplete dirs to be removed; got %q", removed)
+	}
+	if !chainIDComplete(complete) {
+		t.Errorf("expected %q to be kept", complete)
+	}
+	for _, path := range []string{incomplete, staging} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be removed; got %v", path, err)
+		}
+	}
+}
+
+func TestCleanIncompleteLinked(t *testing.T) {
+	defer func(s Storage) { DefaultStorage = s }(DefaultStorage)
+	DefaultStorage = StorageNaive
+	dir, err := ioutil.TempDir("", "test-clean.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	m := newImage(t, layouts, "example.com/app",
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"}))
+	m.Ref = "latest"
+	el, err := Extract(extracts, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as extracted before the completion markers
+	rootfs, err := os.Readlink((Ref{Name: "latest", Layout: el}).RootFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(rootfs + completeSuffix); err != nil {
+		t.Fatal(err)
+	}
+	unlinked, err := el.chainIDPath("sha256", "26ab43e7d8f84043e608d1be92d9918a8aa6860489b6f221f29bc49d0081c3c3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(unlinked, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := CleanIncomplete(extracts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != unlinked {
+		t.Errorf("expected only %q to be removed; got %q", unlinked, removed)
+	}
+	// the rootfs a ref links to is adopted
+	if !chainIDComplete(rootfs) {
+		t.Errorf("expected %q to be kept, and marked complete", rootfs)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/motd")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExtractAll(t *testing.T) {
+	layouts, err := layout.WalkForLayouts("../testdata/layouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := layouts["tianon/true"]
+	desc, err := l.GetRef("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := []*layout.Manifest{}
+	for _, ref := range []string{"latest", "broken", "stable", "v1"} {
+		m, err := layout.ManifestFromDescriptor(l, desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Ref = ref
+		if ref == "broken" {
+			m.Manifest.Config.Digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+		}
+		manifests = append(manifests, m)
+	}
+
+	dir, err := ioutil.TempDir("", "test-extractall.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := ExtractAll(dir, manifests, 4)
+	if len(results) != len(manifests) {
+		t.Fatalf("expected %d results; got %d", len(manifests), len(results))
+	}
+	for i, result := range results {
+		if result.Manifest != manifests[i] {
+			t.Errorf("%d: expected the results in the order of the manifests", i)
+		}
+		if (result.Err != nil) != (result.Manifest.Ref == "broken") {
+			t.Errorf("%s: unexpected error %v", result.Manifest.Ref, result.Err)
+			continue
+		}
+		if result.Err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(result.Layout.rootfsPath(result.Manifest.Ref), "true")); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package extract
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+	"github.com/vbatts/oci-systemd-generator/util"
+)
+
+// GCOptions are the settings for GC
+type GCOptions struct {
+	// DryRun only reports what would be removed
+	DryRun bool
+
+	// KeepOrphans keeps the extracted refs whose image layout (or ref in it) is
+	// no longer present, along with what they link to.
+	KeepOrphans bool
+
+	// MinAge is how long since an object was last written before it may be
+	// removed, so that the objects of an extraction still in progress are left.
+	MinAge time.Duration
+}
+
+// GCResult is what GC removed (or would remove, for a dry run)
+type GCResult struct {
+	Refs     []string // `names/<name>/<ref>` directories of orphaned refs
+	Configs  []string // `configs/` objects
+	ChainIDs []string // `dirs/chainID/` directories, and `overlays/` files
+	Layers   []string // `layers/` directories
+	Verified []string // `verified/` records of blobs no longer present
+
+	// Mounted are the `names/<name>/<ref>` directories of orphaned refs that
+	// were kept, as something under them (like an overlay) is still mounted.
+	Mounted []string
+}
+
+// GC is a mark and sweep of the extracts directory at rootpath. Every config
+// and chainID directory linked from an extracted ref (including from its
+// generations) is marked, and the rest are removed. An extracted ref whose
+// image layout or ref is not in layouts is an orphan, which is removed first
+// (unless opts.KeepOrphans), so that what only it linked to is removed too.
+//
+// An orphan with anything mounted under it is kept, along with what it links
+// to, rather than removed through the mount. The records of the "verified"
+// blob cache whose blobs are all gone are removed, and "tmp" is not touched
+// (see CleanIncomplete).
+// It holds the store lock exclusive, so it waits for extractions in progress.
+func GC(rootpath string, layouts layout.Layouts, opts GCOptions) (*GCResult, error) {
+	storeLock, err := LockStore(rootpath, true)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+
+	result := &GCResult{Refs: []string{}, Configs: []string{}, ChainIDs: []string{}, Layers: []string{}, Verified: []string{}, Mounted: []string{}}
+	cache := &layout.BlobCache{Path: filepath.Join(rootpath, nameVerified)}
+	if result.Verified, err = cache.Prune(opts.DryRun); err != nil {
+		return result, err
+	}
+	extracts, err := WalkForExtracts(rootpath)
+	if err == ErrNoExtracts {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	mounts, err := mountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	// mark
+	configs := map[string]bool{}
+	chainIDs := map[string]bool{}
+	overlays := map[string]bool{}
+	layers := map[string]bool{}
+	mark := func(marks map[string]bool, path string) {
+		if target, err := os.Readlink(path); err == nil {
+			marks[pathDigest(target)] = true
+		}
+	}
+	markRootfs := func(path string) {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return
+		}
+		// a file of overlay layers, or a chainID directory
+		if lowers, err := readOverlayLayers(target); err == nil {
+			overlays[pathDigest(target)] = true
+			for _, lower := range lowers.Lower {
+				layers[pathDigest(lower)] = true
+			}
+			return
+		}
+		chainIDs[pathDigest(target)] = true
+	}
+	for _, el := range extracts {
+		refs, err := el.Refs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			refDir := filepath.Dir(el.refPath(ref.Name))
+			orphaned := !opts.KeepOrphans && ref.Orphaned(layouts) && oldEnough(el.refPath(ref.Name), opts.MinAge)
+			if orphaned && mountedUnder(refDir, mounts) {
+				util.Debugf("%s/%s is orphaned, but has a mount under %q. Keeping it.", el.Name, ref.Name, refDir)
+				result.Mounted = append(result.Mounted, refDir)
+				orphaned = false
+			}
+			if orphaned {
+				util.Debugf("%s/%s is orphaned", el.Name, ref.Name)
+				if !opts.DryRun {
+					if err := os.RemoveAll(refDir); err != nil {
+						return result, err
+					}
+					// no one else can hold its lock while the store's is exclusive
+					os.Remove(el.refLockPath(ref.Name))
+					removeEmptyParents(filepath.Dir(refDir), filepath.Join(rootpath, nameNames))
+				}
+				result.Refs = append(result.Refs, refDir)
+				continue
+			}
+			mark(configs, el.refPath(ref.Name))
+			markRootfs(ref.RootFS())
+			gens, err := ref.Generations()
+			if err != nil {
+				return nil, err
+			}
+			for _, g := range gens {
+				mark(configs, g.ConfigPath())
+				markRootfs(g.RootFS())
+			}
+		}
+	}
+
+	// sweep configs/<hashName>/<shard>/<sum>
+	matches, err := filepath.Glob(filepath.Join(rootpath, nameConfigs, "*", "*", "*"))
+	if err != nil {
+		return result, err
+	}
+	for _, path := range matches {
+		if configs[pathDigest(path)] || !oldEnough(path, opts.MinAge) {
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil {
+				return result, err
+			}
+		}
+		result.Configs = append(result.Configs, path)
+	}
+
+	// sweep overlays/<hashName>/<shard>/<sum>
+	matches, err = filepath.Glob(filepath.Join(rootpath, nameOverlays, "*", "*", "*"))
+	if err != nil {
+		return result, err
+	}
+	for _, path := range matches {
+		if overlays[pathDigest(path)] || !oldEnough(path, opts.MinAge) {
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil {
+				return result, err
+			}
+		}
+		result.ChainIDs = append(result.ChainIDs, path)
+	}
+
+	// sweep dirs/chainID/<hashName>/<shard>/<sum>, and the same for layers.
+	// Those without a marker are for CleanIncomplete, as they may be in the
+	// middle of being extracted.
+	store := Layout{Root: rootpath}
+	for _, sweep := range []struct {
+		dir, lockDir string
+		marks        map[string]bool
+		found        *[]string
+	}{
+		{nameChainIDDir, filepath.Join(nameLocks, nameChainID), chainIDs, &result.ChainIDs},
+		{nameLayers, filepath.Join(nameLocks, nameLayers), layers, &result.Layers},
+	} {
+		matches, err = filepath.Glob(filepath.Join(rootpath, sweep.dir, "*", "*", "*"+completeSuffix))
+		if err != nil {
+			return result, err
+		}
+		for _, marker := range matches {
+			path := strings.TrimSuffix(marker, completeSuffix)
+			if sweep.marks[pathDigest(path)] || !oldEnough(marker, opts.MinAge) {
+				continue
+			}
+			if !opts.DryRun {
+				if err := removeChainID(path); err != nil {
+					return result, err
+				}
+				// no one else can hold its lock while the store's is exclusive
+				hashName := filepath.Base(filepath.Dir(filepath.Dir(path)))
+				if lockPath, err := store.shardedPath(sweep.lockDir, hashName, filepath.Base(path)); err == nil {
+					os.Remove(lockPath)
+				}
+			}
+			*sweep.found = append(*sweep.found, path)
+		}
+	}
+	return result, nil
+}
+
+// oldEnough is whether path was last modified at least minAge ago
+func oldEnough(path string, minAge time.Duration) bool {
+	if minAge <= 0 {
+		return true
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	return time.Since(info.ModTime()) >= minAge
+}
+
+// mountInfoPath is the mount table of this process
+var mountInfoPath = "/proc/self/mountinfo"
+
+// mountPoints is the mount point of every mount in mountInfoPath
+func mountPoints() ([]string, error) {
+	fh, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	mounts := []string{}
+	s := bufio.NewScanner(fh)
+	for s.Scan() {
+		// like "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw"
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPath(fields[4]))
+	}
+	return mounts, s.Err()
+}
+
+// unescapeMountPath undoes the octal escapes (like `\040` for a space) of a
+// path in the mount table
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// mountedUnder is whether dir, or anything under it, is one of mounts
+func mountedUnder(dir string, mounts []string) bool {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	for _, mount := range mounts {
+		if mount == dir || strings.HasPrefix(mount, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyParents removes dir, and its parents up to (but not including)
+// top, for as long as they are empty.
+func removeEmptyParents(dir, top string) {
+	for dir != top && strings.HasPrefix(dir, top) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
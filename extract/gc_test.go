@@ -0,0 +1,186 @@
+package extract
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+func TestGC(t *testing.T) {
+	layouts, err := layout.WalkForLayouts("../testdata/layouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := layouts["tianon/true"]
+	desc, err := l.GetRef("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := layout.ManifestFromDescriptor(l, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Ref = "latest"
+
+	dir, err := ioutil.TempDir("", "test-gc.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	el, err := Extract(dir, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := os.Readlink(el.rootfsPath("latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a layout removed from the image layouts dir
+	gone := Layout{Root: dir, Name: "example.com/gone", HashName: DefaultHashName}
+	fakeGeneration(t, gone, "stable", "zaphod", "26ab43e7d8f84043e608d1be92d9918a8aa6860489b6f221f29bc49d0081c3c3")
+	// and objects nothing links to
+	if _, err := el.storeConfig(strings.NewReader("arthur")); err != nil {
+		t.Fatal(err)
+	}
+	unlinked, err := el.chainIDPath("sha256", "ba0000000000000000000000000000000000000000000000000000000000000b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(unlinked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := markComplete(unlinked); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(r *GCResult) [3]int {
+		return [3]int{len(r.Refs), len(r.Configs), len(r.ChainIDs)}
+	}
+
+	// too new to be removed
+	result, err := GC(dir, layouts, GCOptions{MinAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(result); got != [3]int{0, 0, 0} {
+		t.Errorf("expected nothing removed before MinAge; got %v", got)
+	}
+
+	result, err = GC(dir, layouts, GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(result); got != [3]int{1, 2, 2} {
+		t.Errorf("expected 1 ref, 2 configs and 2 chainIDs; got %v", got)
+	}
+	if !chainIDComplete(unlinked) {
+		t.Errorf("expected %q to be left by a dry run", unlinked)
+	}
+
+	result, err = GC(dir, layouts, GCOptions{KeepOrphans: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(result); got != [3]int{0, 1, 1} {
+		t.Errorf("expected only the unlinked config and chainID; got %v", got)
+	}
+	if _, err := os.Stat(unlinked); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be removed; got %v", unlinked, err)
+	}
+
+	result, err = GC(dir, layouts, GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(result); got != [3]int{1, 1, 1} {
+		t.Errorf("expected the orphaned ref, its config and chainID; got %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, nameNames, "example.com")); !os.IsNotExist(err) {
+		t.Errorf("expected the orphaned layout's names to be removed; got %v", err)
+	}
+	if !chainIDComplete(live) {
+		t.Errorf("expected %q to be kept", live)
+	}
+	if _, err := os.Stat(filepath.Join(el.rootfsPath("latest"), "true")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGCMounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-gc.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { mountInfoPath = path }(mountInfoPath)
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+
+	gone := Layout{Root: dir, Name: "example.com/gone app", HashName: DefaultHashName}
+	fakeGeneration(t, gone, "stable", "zaphod", "26ab43e7d8f84043e608d1be92d9918a8aa6860489b6f221f29bc49d0081c3c3")
+	rootfs, err := gone.chainIDPath("sha256", "26ab43e7d8f84043e608d1be92d9918a8aa6860489b6f221f29bc49d0081c3c3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refDir := filepath.Dir(gone.refPath("stable"))
+	merged := strings.Replace(filepath.Join(refDir, nameOverlay, nameMerged), " ", `\040`, -1)
+	mountInfo := "22 1 0:21 / / rw,relatime shared:1 - ext4 /dev/root rw\n" +
+		"100 22 0:50 / " + merged + " rw,relatime shared:60 - overlay overlay rw,lowerdir=/a:/b\n"
+	if err := ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the orphan is kept while its overlay is mounted, with what it links to
+	result, err := GC(dir, layout.Layouts{}, GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Refs) != 0 || len(result.ChainIDs) != 0 || len(result.Configs) != 0 {
+		t.Errorf("expected nothing removed; got %+v", result)
+	}
+	if len(result.Mounted) != 1 || result.Mounted[0] != refDir {
+		t.Errorf("expected %q to be kept as mounted; got %v", refDir, result.Mounted)
+	}
+	if !chainIDComplete(rootfs) {
+		t.Errorf("expected %q to be kept", rootfs)
+	}
+
+	// and removed once it is not
+	if err := ioutil.WriteFile(mountInfoPath, []byte(strings.SplitAfter(mountInfo, "\n")[0]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = GC(dir, layout.Layouts{}, GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Refs) != 1 || len(result.Mounted) != 0 {
+		t.Errorf("expected the orphan to be removed; got %+v", result)
+	}
+}
+
+func TestOrphaned(t *testing.T) {
+	layouts, err := layout.WalkForLayouts("../testdata/layouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, ref string
+		orphaned  bool
+	}{
+		{"tianon/true", "latest", false},
+		{"tianon/true", "stable", true},
+		{"example.com/gone", "latest", true},
+	} {
+		ref := Ref{Name: tc.ref, Layout: &Layout{Name: tc.name}}
+		if got := ref.Orphaned(layouts); got != tc.orphaned {
+			t.Errorf("%s/%s: expected orphaned to be %t; got %t", tc.name, tc.ref, tc.orphaned, got)
+		}
+	}
+}
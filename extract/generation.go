@@ -0,0 +1,304 @@
+package extract
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/vbatts/oci-systemd-generator/util"
+)
+
+// Each extraction of a ref is recorded as a numbered generation under the
+// ref's `generations/` directory, with its own config and rootfs links and an
+// `info` file. The ref's top-level config and rootfs links are those of the
+// current generation (linked from `current`), so rolling back is only a matter
+// of swapping those links to an older generation.
+
+// KeepGenerations is how many generations of each ref are kept. The oldest
+// are removed as new ones are extracted, except for the current generation.
+var KeepGenerations = 3
+
+// ErrNoGeneration is returned when a ref does not have the generation asked for
+var ErrNoGeneration = errors.New("no such generation")
+
+// Generation is one extraction of a ref
+type Generation struct {
+	Number int  `json:"-"`
+	Ref    *Ref `json:"-"`
+
+	Created  time.Time `json:"created"`
+	Manifest string    `json:"manifest,omitempty"` // digest of the image manifest
+	Config   string    `json:"config"`             // digest of the image config
+}
+
+// ConfigPath is the path to the symlink to this generation's config
+func (g Generation) ConfigPath() string {
+	return filepath.Join(g.Ref.Layout.generationPath(g.Ref.Name, g.Number), nameRef)
+}
+
+// RootFS is the path to the symlink to this generation's root filesystem
+func (g Generation) RootFS() string {
+	return filepath.Join(g.Ref.Layout.generationPath(g.Ref.Name, g.Number), nameRootfs)
+}
+
+// HasConfig is whether this generation is of the config of digest.
+// See Ref.HasConfig.
+func (g Generation) HasConfig(digest string) (bool, error) {
+	return hasConfig(g.ConfigPath(), digest)
+}
+
+// Generations of this ref, oldest first. Refs extracted before generations
+// were kept have none.
+func (r *Ref) Generations() ([]*Generation, error) {
+	infos, err := ioutil.ReadDir(r.Layout.generationsPath(r.Name))
+	if err != nil && os.IsNotExist(err) {
+		return []*Generation{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	gens := []*Generation{}
+	for _, info := range infos {
+		n, err := strconv.Atoi(info.Name())
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		g, err := r.Generation(n)
+		if err != nil {
+			util.Debugf("%s/%s: generation %d: %s", r.Layout.Name, r.Name, n, err)
+			continue
+		}
+		gens = append(gens, g)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].Number < gens[j].Number })
+	return gens, nil
+}
+
+// Generation number n of this ref
+func (r *Ref) Generation(n int) (*Generation, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(r.Layout.generationPath(r.Name, n), nameInfo))
+	if err != nil && os.IsNotExist(err) {
+		return nil, ErrNoGeneration
+	} else if err != nil {
+		return nil, err
+	}
+	g := Generation{}
+	if err := json.Unmarshal(buf, &g); err != nil {
+		return nil, err
+	}
+	g.Number = n
+	g.Ref = r
+	return &g, nil
+}
+
+// CurrentGeneration is the generation this ref's config and rootfs are linked
+// to. Returns ErrNoGeneration if the ref has no generations.
+func (r *Ref) CurrentGeneration() (*Generation, error) {
+	target, err := os.Readlink(r.Layout.currentPath(r.Name))
+	if err != nil && os.IsNotExist(err) {
+		return nil, ErrNoGeneration
+	} else if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(filepath.Base(target))
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: bad current generation %q", r.Layout.Name, r.Name, target)
+	}
+	return r.Generation(n)
+}
+
+// LatestGeneration is the most recently extracted generation of this ref,
+// which is not the current one if the ref was rolled back. Returns
+// ErrNoGeneration if the ref has no generations.
+func (r *Ref) LatestGeneration() (*Generation, error) {
+	gens, err := r.Generations()
+	if err != nil {
+		return nil, err
+	}
+	if len(gens) == 0 {
+		return nil, ErrNoGeneration
+	}
+	return gens[len(gens)-1], nil
+}
+
+// Rollback links this ref's config and rootfs to generation n. If n is 0, the
+// generation before the current one is used.
+func (r *Ref) Rollback(n int) (*Generation, error) {
+	storeLock, err := LockStore(r.Layout.Root, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeLock.Unlock()
+	refLock, err := r.Layout.lockRef(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer refLock.Unlock()
+
+	if n == 0 {
+		current, err := r.CurrentGeneration()
+		if err != nil {
+			return nil, err
+		}
+		gens, err := r.Generations()
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range gens {
+			if g.Number < current.Number {
+				n = g.Number
+			}
+		}
+		if n == 0 {
+			return nil, ErrNoGeneration
+		}
+	}
+	g, err := r.Generation(n)
+	if err != nil {
+		return nil, err
+	}
+	// the rootfs may have been removed since
+	rootfs, err := os.Readlink(g.RootFS())
+	if err != nil {
+		return nil, err
+	}
+	if !r.Layout.rootfsComplete(rootfs) {
+		return nil, fmt.Errorf("%s/%s: generation %d: %q is not extracted", r.Layout.Name, r.Name, n, rootfs)
+	}
+	if err := r.Layout.setCurrent(g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// addGeneration records a new generation of ref, linking to the config and
+// rootfs paths, and prunes the oldest beyond KeepGenerations. It does not make
+// the new generation current.
+func (l Layout) addGeneration(ref, manifestDigest, config, rootfs string) (*Generation, error) {
+	r := &Ref{Name: ref, Layout: &l}
+	gens, err := r.Generations()
+	if err != nil {
+		return nil, err
+	}
+	n := 1
+	if len(gens) > 0 {
+		n = gens[len(gens)-1].Number + 1
+	}
+	g := &Generation{
+		Number:   n,
+		Ref:      r,
+		Created:  time.Now().UTC(),
+		Manifest: manifestDigest,
+		Config:   pathDigest(config),
+	}
+
+	// populated aside, and renamed into place
+	tmp, err := l.tmpPath()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Symlink(config, filepath.Join(tmp, nameRef)); err != nil {
+		return nil, err
+	}
+	if err := os.Symlink(rootfs, filepath.Join(tmp, nameRootfs)); err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, nameInfo), buf, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(l.generationsPath(ref), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, l.generationPath(ref, n)); err != nil {
+		return nil, err
+	}
+
+	if err := l.pruneGenerations(r, n); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// upToDate is whether the latest generation of ref is of config and rootfs,
+// and the ref's rootfs is there.
+func (l Layout) upToDate(ref, config, rootfs string) bool {
+	r := &Ref{Name: ref, Layout: &l}
+	g, err := r.LatestGeneration()
+	if err != nil {
+		return false
+	}
+	if target, err := os.Readlink(g.ConfigPath()); err != nil || target != config {
+		return false
+	}
+	if target, err := os.Readlink(g.RootFS()); err != nil || target != rootfs {
+		return false
+	}
+	_, err = os.Stat(r.RootFS())
+	return err == nil
+}
+
+// pruneGenerations removes the oldest generations of r beyond
+// KeepGenerations, other than generation keep and the current one.
+func (l Layout) pruneGenerations(r *Ref, keep int) error {
+	if KeepGenerations < 1 {
+		return nil
+	}
+	gens, err := r.Generations()
+	if err != nil {
+		return err
+	}
+	current := 0
+	if g, err := r.CurrentGeneration(); err == nil {
+		current = g.Number
+	}
+	remaining := len(gens)
+	for _, g := range gens {
+		if remaining <= KeepGenerations {
+			break
+		}
+		if g.Number == keep || g.Number == current {
+			continue
+		}
+		util.Debugf("removing generation %d of %s/%s", g.Number, l.Name, r.Name)
+		if err := os.RemoveAll(l.generationPath(r.Name, g.Number)); err != nil {
+			return err
+		}
+		remaining--
+	}
+	return nil
+}
+
+// setCurrent links the ref's rootfs, config and then `current` to those of
+// generation g. The config link is swapped after the rootfs, as it is what
+// marks the ref as up to date (see DetermineNotExtracted).
+func (l Layout) setCurrent(g *Generation) error {
+	ref := g.Ref.Name
+	rootfs, err := os.Readlink(g.RootFS())
+	if err != nil {
+		return err
+	}
+	config, err := os.Readlink(g.ConfigPath())
+	if err != nil {
+		return err
+	}
+	if err := swapSymlink(rootfs, l.rootfsPath(ref)); err != nil {
+		return err
+	}
+	if err := swapSymlink(config, l.refPath(ref)); err != nil {
+		return err
+	}
+	return swapSymlink(filepath.Join(nameGenerations, strconv.Itoa(g.Number)), l.currentPath(ref))
+}
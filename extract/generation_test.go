@@ -0,0 +1,130 @@
+package extract
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+// fakeGeneration makes a generation of ref current, for a config of content
+// and an empty (but complete) chainID dir of sum.
+func fakeGeneration(t *testing.T, el Layout, ref, content, sum string) *Generation {
+	config, err := el.storeConfig(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs, err := el.chainIDPath("sha256", sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := markComplete(rootfs); err != nil {
+		t.Fatal(err)
+	}
+	g, err := el.addGeneration(ref, "", config, rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := el.setCurrent(g); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGenerations(t *testing.T) {
+	layouts, err := layout.WalkForLayouts("../testdata/layouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := layouts["tianon/true"]
+	desc, err := l.GetRef("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := layout.ManifestFromDescriptor(l, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Ref = "latest"
+
+	dir, err := ioutil.TempDir("", "test-generations.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	el := Layout{Root: dir, Name: "tianon/true", HashName: DefaultHashName}
+	ref := &Ref{Name: "latest", Layout: &el}
+
+	// the ref was at an older image, before moving to m
+	old := fakeGeneration(t, el, "latest", "zaphod", "26ab43e7d8f84043e608d1be92d9918a8aa6860489b6f221f29bc49d0081c3c3")
+	if _, err := Extract(dir, m); err != nil {
+		t.Fatal(err)
+	}
+	current, err := ref.CurrentGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Number != 2 || current.Manifest != desc.Digest || current.Config != m.Manifest.Config.Digest {
+		t.Errorf("expected generation 2 of %q; got %d of %q (%q)", desc.Digest, current.Number, current.Manifest, current.Config)
+	}
+
+	g, err := ref.Rollback(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Number != old.Number {
+		t.Errorf("expected to roll back to generation %d; got %d", old.Number, g.Number)
+	}
+	rootfs, err := os.Readlink(ref.RootFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRootfs, err := os.Readlink(old.RootFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootfs != oldRootfs {
+		t.Errorf("expected rootfs to be %q; got %q", oldRootfs, rootfs)
+	}
+	if _, err := ref.Rollback(0); err != ErrNoGeneration {
+		t.Errorf("expected %q rolling back from the first generation; got %v", ErrNoGeneration, err)
+	}
+
+	// the layout still has the ref at m, which must not undo the rollback
+	ne, err := DetermineNotExtracted([]*Layout{&el}, []*layout.Manifest{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ne) != 0 {
+		t.Errorf("expected the rolled back ref to be left; got %d to extract", len(ne))
+	}
+
+	// only KeepGenerations are kept, and never the current one
+	defer func(n int) { KeepGenerations = n }(KeepGenerations)
+	KeepGenerations = 2
+	oldConfig, err := os.Readlink(old.ConfigPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := el.addGeneration("latest", "", oldConfig, oldRootfs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gens, err := ref.Generations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := []int{}
+	for _, g := range gens {
+		numbers = append(numbers, g.Number)
+	}
+	if len(numbers) != 2 || numbers[0] != 1 || numbers[1] != 4 {
+		t.Errorf("expected generations [1 4]; got %v", numbers)
+	}
+}
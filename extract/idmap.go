@@ -0,0 +1,138 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+	"github.com/vbatts/oci-systemd-generator/util"
+)
+
+// IDMapping maps the IDs ContainerID to ContainerID+Size-1 of an image to
+// HostID and on, like a line of /proc/<pid>/uid_map (see user_namespaces(7)).
+type IDMapping struct {
+	ContainerID, HostID, Size int
+}
+
+// IDMap is how the owners of an image's files are shifted when it is
+// extracted, for running it in a user namespace. A nil IDMap shifts nothing.
+type IDMap struct {
+	UIDs []IDMapping
+	GIDs []IDMapping
+}
+
+// IDMaps are the IDMap of the images extracted by Extract, by layout name
+var IDMaps = map[string]*IDMap{}
+
+// overflowID is what an ID without a mapping is shifted to, like the kernel's
+// overflowuid and overflowgid
+const overflowID = 65534
+
+// ParseIDMap parses "<uids> [<gids>]", each a comma separated list of
+// "<container id>:<host id>:<size>" (like "0:100000:65536"). Without gids,
+// they are mapped the same as uids.
+func ParseIDMap(s string) (*IDMap, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("expected \"<uids> [<gids>]\"; got %q", s)
+	}
+	uids, err := parseIDMappings(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	gids := uids
+	if len(fields) == 2 {
+		if gids, err = parseIDMappings(fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	return &IDMap{UIDs: uids, GIDs: gids}, nil
+}
+
+func parseIDMappings(s string) ([]IDMapping, error) {
+	mappings := []IDMapping{}
+	for _, part := range strings.Split(s, ",") {
+		nums := strings.Split(part, ":")
+		if len(nums) != 3 {
+			return nil, fmt.Errorf("expected \"<container id>:<host id>:<size>\"; got %q", part)
+		}
+		ids := [3]int{}
+		for i, num := range nums {
+			n, err := strconv.ParseUint(num, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %s", part, err)
+			}
+			ids[i] = int(n)
+		}
+		m := IDMapping{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}
+		if m.Size == 0 || uint64(m.ContainerID)+uint64(m.Size) > 1<<32 || uint64(m.HostID)+uint64(m.Size) > 1<<32 {
+			return nil, fmt.Errorf("%q: out of range", part)
+		}
+		for _, other := range mappings {
+			if m.ContainerID < other.ContainerID+other.Size && other.ContainerID < m.ContainerID+m.Size {
+				return nil, fmt.Errorf("%q: overlaps another mapping", part)
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// String is m as ParseIDMap parses it
+func (m *IDMap) String() string {
+	format := func(mappings []IDMapping) string {
+		parts := []string{}
+		for _, mapping := range mappings {
+			parts = append(parts, fmt.Sprintf("%d:%d:%d", mapping.ContainerID, mapping.HostID, mapping.Size))
+		}
+		return strings.Join(parts, ",")
+	}
+	return format(m.UIDs) + " " + format(m.GIDs)
+}
+
+// shift the uid and gid of an image's file. IDs without a mapping are shifted
+// to overflowID, and an error is returned.
+func (m *IDMap) shift(uid, gid int) (int, int, error) {
+	var err error
+	shiftedUID, ok := shiftID(m.UIDs, uid)
+	if !ok {
+		err = fmt.Errorf("uid %d is not mapped", uid)
+	}
+	shiftedGID, ok := shiftID(m.GIDs, gid)
+	if !ok && err == nil {
+		err = fmt.Errorf("gid %d is not mapped", gid)
+	}
+	return shiftedUID, shiftedGID, err
+}
+
+func shiftID(mappings []IDMapping, id int) (int, bool) {
+	for _, m := range mappings {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return overflowID, false
+}
+
+// key is what the chainID (or diff_id) d is stored as, when extracted with m.
+// It is a digest of d and m, so that shifted and unshifted extracts of d do
+// not collide.
+func (m *IDMap) key(d *layout.DigestRef) (*layout.DigestRef, error) {
+	if m == nil {
+		return d, nil
+	}
+	return keyDigest(d, m.String())
+}
+
+// keyDigest is the digest of d and what it is keyed by, with d's hash
+func keyDigest(d *layout.DigestRef, by string) (*layout.DigestRef, error) {
+	hash, ok := util.HashMap[d.HashName()]
+	if !ok {
+		return nil, util.ErrNoHash
+	}
+	h := hash.New()
+	io.WriteString(h, d.Name+"\n"+by+"\n")
+	return &layout.DigestRef{Name: fmt.Sprintf("%s:%x", d.HashName(), h.Sum(nil))}, nil
+}
@@ -0,0 +1,125 @@
+package extract
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap("0:100000:1000,1000:200000:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.String() != "0:100000:1000,1000:200000:10 0:100000:1000,1000:200000:10" {
+		t.Errorf("expected the gids to be mapped as the uids; got %q", m.String())
+	}
+	for _, ids := range [][4]int{
+		{0, 0, 100000, 100000},
+		{999, 1005, 100999, 200005},
+		{1010, 5000, overflowID, overflowID},
+	} {
+		uid, gid, _ := m.shift(ids[0], ids[1])
+		if uid != ids[2] || gid != ids[3] {
+			t.Errorf("expected %d:%d to be shifted to %d:%d; got %d:%d", ids[0], ids[1], ids[2], ids[3], uid, gid)
+		}
+	}
+	if _, _, err := m.shift(0, 5000); err == nil {
+		t.Error("expected an unmapped gid to fail")
+	}
+
+	for _, bad := range []string{
+		"",
+		"0:100000",
+		"0:100000:0",
+		"0:-1:10",
+		"0:100000:10,5:200000:10",
+		"0:4294967295:2",
+		"0:100000:10 0:100000:10 0:100000:10",
+	} {
+		if _, err := ParseIDMap(bad); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestExtractIDMap(t *testing.T) {
+	defer func(s Storage) { DefaultStorage = s }(DefaultStorage)
+	DefaultStorage = StorageNaive
+	dir, err := ioutil.TempDir("", "test-idmap.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	m := newImage(t, layouts, "example.com/app",
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "home/user/.profile", Uid: 1000, Gid: 100}, body: "\n"}))
+	m.Ref = "latest"
+	el, err := Extract(extracts, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := Ref{Name: "latest", Layout: el}
+	unshifted, err := os.Readlink(ref.RootFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idmap, err := ParseIDMap("0:100000:65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	IDMaps[m.Layout.Name] = idmap
+	defer delete(IDMaps, m.Layout.Name)
+
+	// the image is extracted again once its idmap changes
+	ne, err := DetermineNotExtracted([]*Layout{el}, []*layout.Manifest{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ne) != 1 {
+		t.Fatalf("expected the image to be extracted again with its idmap; got %v", ne)
+	}
+	if _, err := Extract(extracts, m); err != nil {
+		t.Fatal(err)
+	}
+	shifted, err := os.Readlink(ref.RootFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shifted == unshifted {
+		t.Fatalf("expected the shifted rootfs to be stored apart from %q", unshifted)
+	}
+	if ne, err := DetermineNotExtracted([]*Layout{el}, []*layout.Manifest{m}); err != nil || len(ne) != 0 {
+		t.Errorf("expected the image to be extracted; got %v (%v)", ne, err)
+	}
+
+	owner := func(path string) (int, int) {
+		if Rootless {
+			uid, gid, err := RootlessOwner(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return uid, gid
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		return int(st.Uid), int(st.Gid)
+	}
+	if uid, gid := owner(filepath.Join(shifted, "home/user/.profile")); uid != 101000 || gid != 100100 {
+		t.Errorf("expected the shifted owner 101000:100100; got %d:%d", uid, gid)
+	}
+	if uid, gid := owner(filepath.Join(unshifted, "home/user/.profile")); uid != 1000 || gid != 100 {
+		t.Errorf("expected the unshifted copy to be kept as it was; got %d:%d", uid, gid)
+	}
+}
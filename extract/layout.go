@@ -6,6 +6,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/vbatts/oci-systemd-generator/util"
 )
@@ -29,6 +32,7 @@ The /var/lib/oci/extract/ hierarchy is:
     |     |- sha256/
     |        |- ba/
     |           |- baabaab1acc24ee9/
+    |           |- baabaab1acc24ee9.complete
     |- configs/
     |  |- sha256/
     |     |- ea/
@@ -38,9 +42,30 @@ The /var/lib/oci/extract/ hierarchy is:
           |- stable/
           |  |- config -> ../../../configs/sha256/ea/ea7beefea7beefd0ee7
           |  |- rootfs -> ../../../dirs/chainID/sha256/ba/baabaab1acc24ee9/
+          |  |- current -> generations/2
+          |  |- generations/
+          |     |- 1/
+          |     |  |- config -> ../../../../../configs/sha256/c0/c0ffeec0ffee
+          |     |  |- rootfs -> ../../../../../dirs/chainID/sha256/f0/f00df00d/
+          |     |  |- info
+          |     |- 2/
+          |        |- config -> ../../../../../configs/sha256/ea/ea7beefea7beefd0ee7
+          |        |- rootfs -> ../../../../../dirs/chainID/sha256/ba/baabaab1acc24ee9/
+          |        |- info
           |- v1.0.0/
              |- config -> ../../../configs/sha256/ea/ea7beefea7beefd0ee7
              |- rootfs -> ../../../dirs/chainID/sha256/ba/baabaab1acc24ee9/
+    |- layers/
+    |  |- sha256/
+    |     |- 8b/
+    |        |- 8b2564fc821995bf/
+    |        |- 8b2564fc821995bf.complete
+    |- overlays/
+    |  |- sha256/
+    |     |- ba/
+    |        |- baabaab1acc24ee9 (the layers of this chainID, for StorageOverlay)
+    |- tmp/
+       |- (staging for chainID dirs, until renamed into place)
 
 */
 type Layout struct {
@@ -58,15 +83,15 @@ var DefaultHashName = "sha256"
 // Refs provides the refs, which contain the symlinks to the corresponding OCI
 // image config object and root filesystem.
 func (l *Layout) Refs() ([]*Ref, error) {
-	// /var/lib/oci/extracts/names/example.com/myapp/stable/ref
-	matches, err := filepath.Glob(l.refPath("*"))
+	// /var/lib/oci/extracts/names/example.com/myapp/stable/config
+	matches, err := filepath.Glob(filepath.Join(l.Root, nameNames, l.Name, "*", nameRef))
 	if err != nil {
 		return nil, err
 	}
 	refs := make([]*Ref, len(matches))
 	for i := range matches {
 		refs[i] = &Ref{
-			Name:   filepath.Base(filepath.Dir(matches[i])),
+			Name:   unescapeRef(filepath.Base(filepath.Dir(matches[i]))),
 			Layout: l,
 		}
 	}
@@ -84,25 +109,37 @@ func (l Layout) GetRef(name string) (io.ReadCloser, error) {
 
 // SetRefConfig for name `ref` takes a reader. Reader `r` is read and written to it's
 // content addressed mapping, and a symbolic link for `ref` is created pointing
-// to this content addressed data.
+// to this content addressed data. If `ref` already links to another config,
+// the link is atomically swapped to the new one.
 func (l Layout) SetRefConfig(refname string, r io.Reader) error {
-	// using Stat to follow symlink
-	if _, err := os.Stat(l.refPath(refname)); err == nil {
-		return os.ErrExist
+	dest, err := l.storeConfig(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.refPath(refname)), 0755); err != nil {
+		return err
 	}
+	// TODO rather than explicit paths, this would be nice to symlink to
+	// ../../../configs/sha256/fc/fc744f333c05dd872a52509e0e4b9da7eed14d7a4d7df1f21fb6f2f3b16d31b4
+	return swapSymlink(dest, l.refPath(refname))
+}
+
+// storeConfig reads r to its content addressed path in the configs
+// directory, and returns that path.
+func (l Layout) storeConfig(r io.Reader) (string, error) {
 	if _, ok := util.HashMap[l.HashName]; !ok {
-		return fmt.Errorf("HashName does not exist: %q", l.HashName)
+		return "", fmt.Errorf("HashName does not exist: %q", l.HashName)
 	}
 
 	tmp, err := l.tmpPath()
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer os.RemoveAll(tmp)
 
 	fh, err := ioutil.TempFile(tmp, "extract-layout.")
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	h := util.HashMap[l.HashName].New()
@@ -110,49 +147,114 @@ func (l Layout) SetRefConfig(refname string, r io.Reader) error {
 
 	if _, err := io.Copy(fh, tr); err != nil {
 		fh.Close()
-		return err
+		return "", err
 	}
 	if err := fh.Close(); err != nil {
-		return err
+		return "", err
 	}
 
-	dest := l.configPath(l.HashName, fmt.Sprintf("%x", h.Sum(nil)))
+	dest, err := l.configPath(l.HashName, fmt.Sprintf("%x", h.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
 	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-		return err
+		return "", err
 	}
 	if err := os.Rename(fh.Name(), dest); err != nil {
-		return err
+		return "", err
 	}
+	return dest, nil
+}
 
-	if err := os.MkdirAll(filepath.Dir(l.refPath(refname)), 0755); err != nil {
+// swapSymlink points the symlink at path to target. An existing link is
+// replaced atomically, by renaming a new link over it.
+func swapSymlink(target, path string) error {
+	if current, err := os.Readlink(path); err == nil && current == target {
+		return nil
+	}
+	tmp := fmt.Sprintf("%s.%d.%d.tmp", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Symlink(target, tmp); err != nil {
 		return err
 	}
-	// TODO rather than explicit paths, this would be nice to symlink to
-	// ../../../configs/sha256/fc/fc744f333c05dd872a52509e0e4b9da7eed14d7a4d7df1f21fb6f2f3b16d31b4
-	if _, err := os.Lstat(l.refPath(refname)); err != nil && os.IsNotExist(err) {
-		if err := os.Symlink(dest, l.refPath(refname)); err != nil {
-			return err
-		}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
 	}
 	return nil
 }
 
 func (l Layout) tmpPath() (string, error) {
-	if err := os.MkdirAll(filepath.Join(l.Root, "tmp"), 0700); err != nil {
+	if err := os.MkdirAll(filepath.Join(l.Root, nameTmp), 0700); err != nil {
 		return "", err
 	}
-	return ioutil.TempDir(filepath.Join(l.Root, "tmp"), "tmp")
+	return ioutil.TempDir(filepath.Join(l.Root, nameTmp), "tmp")
+}
+
+// shardedPath is the path for digest hashName:sum under dir, sharded by the
+// first two characters of the sum. The digest is validated first, as it
+// otherwise could lead outside of dir.
+func (l Layout) shardedPath(dir, hashName, sum string) (string, error) {
+	if err := util.ValidateDigest(hashName + ":" + sum); err != nil {
+		return "", fmt.Errorf("%q: %s", hashName+":"+sum, err)
+	}
+	return filepath.Join(l.Root, dir, hashName, sum[0:2], sum), nil
+}
+func (l Layout) chainIDPath(hashName, sum string) (string, error) {
+	return l.shardedPath(nameChainIDDir, hashName, sum)
+}
+func (l Layout) configPath(hashName, sum string) (string, error) {
+	return l.shardedPath(nameConfigs, hashName, sum)
+}
+func (l Layout) layerPath(hashName, sum string) (string, error) {
+	return l.shardedPath(nameLayers, hashName, sum)
 }
 
-func (l Layout) chainIDPath(hashName, sum string) string {
-	return filepath.Join(l.Root, nameChainIDDir, hashName, sum[0:2], sum)
+// refDir is the directory of ref under `names/<name>/`. The ref is escaped to
+// a single path element (see escapeRef), so that it can not lead elsewhere.
+func (l Layout) refDir(ref string) string {
+	return filepath.Join(l.Root, nameNames, l.Name, escapeRef(ref))
 }
-func (l Layout) configPath(hashName, sum string) string {
-	return filepath.Join(l.Root, nameConfigs, hashName, sum[0:2], sum)
+func (l Layout) overlayPath(ref, name string) string {
+	return filepath.Join(l.refDir(ref), nameOverlay, name)
 }
 func (l Layout) rootfsPath(ref string) string {
-	return filepath.Join(l.Root, nameNames, l.Name, ref, nameRootfs)
+	return filepath.Join(l.refDir(ref), nameRootfs)
 }
 func (l Layout) refPath(ref string) string {
-	return filepath.Join(l.Root, nameNames, l.Name, ref, nameRef)
+	return filepath.Join(l.refDir(ref), nameRef)
+}
+func (l Layout) currentPath(ref string) string {
+	return filepath.Join(l.refDir(ref), nameCurrent)
+}
+func (l Layout) generationsPath(ref string) string {
+	return filepath.Join(l.refDir(ref), nameGenerations)
+}
+
+var (
+	refEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	refUnescaper = strings.NewReplacer("%2F", "/", "%2E", ".", "%25", "%")
+)
+
+// escapeRef makes ref a single path element: "/" (as in "v1/beta") and "%"
+// are escaped, as is a leading "." (so neither "." nor ".." are left), and an
+// empty ref is "%". unescapeRef reverses it.
+func escapeRef(ref string) string {
+	if ref == "" {
+		return "%"
+	}
+	ref = refEscaper.Replace(ref)
+	if strings.HasPrefix(ref, ".") {
+		ref = "%2E" + ref[1:]
+	}
+	return ref
+}
+
+func unescapeRef(name string) string {
+	if name == "%" {
+		return ""
+	}
+	return refUnescaper.Replace(name)
+}
+func (l Layout) generationPath(ref string, n int) string {
+	return filepath.Join(l.generationsPath(ref), strconv.Itoa(n))
 }
@@ -42,6 +42,36 @@ func TestLayoutManifest(t *testing.T) {
 	if filepath.Base(manifestName) != expected {
 		t.Fatalf("expected ref to be at %q; but got %q", expected, filepath.Base(manifestName))
 	}
+	fh.Close()
+
+	// setting the ref again swaps it to the new config
+	if err := l.SetRefConfig("stable", strings.NewReader("zaphod")); err != nil {
+		t.Fatal(err)
+	}
+	ref := Ref{Name: "stable", Layout: &l}
+	digest, err := ref.ConfigDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "sha256:ea68e4e2ad68ef05d4a9da946b735da0841bb862e104be1ea0a5f2f4961e0c8b"
+	if digest != expected {
+		t.Errorf("expected ref to be at %q; but got %q", expected, digest)
+	}
+
+	// digests of another hash are compared by summing the config
+	for digest, expect := range map[string]bool{
+		"sha512:917ac6706cb684c4632a300d30556ff3205970feaf151894caef148d764f092cf7371f56d799eda0022a0c4394a521bbcc0a2b5ea34e292a75b7f1e6a947ae95": true,
+		"sha512:00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000": false,
+		"sha256:8fe85f31aa6fa5ff4e5cb7d03497e9a78c0f8492ec2da21279adedbc312976cf":                                                                 false,
+	} {
+		same, err := ref.HasConfig(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same != expect {
+			t.Errorf("%q: expected %t; got %t", digest, expect, same)
+		}
+	}
 }
 
 func TestConfig(t *testing.T) {
@@ -0,0 +1,218 @@
+package extract
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The extracts directory is shared by every run of the generator, so it is
+// guarded by flock(2) on files under its "locks" directory:
+//
+// - `locks/store` is held shared while extracting, and exclusive by what
+//   removes from the store (CleanIncomplete and GC).
+// - `locks/chainID/<hashName>/<sum>` is held exclusive while a chainID
+//   directory is checked and extracted.
+// - `locks/layers/<hashName>/<sum>` is the same, for a layer of StorageOverlay.
+// - `locks/names/<name>/<ref>.lock` is held exclusive while a ref's links and
+//   generations are changed.
+//
+// They are always taken in that order. The lock files are left in place, as
+// removing one that another process has open would let two processes hold it.
+//
+// flock(2) is per open file, so goroutines of the same process (like the
+// workers of ExtractAll) would also time out on each other's locks, though
+// images sharing layers are expected to wait for one another's extraction.
+// So an exclusive lock is first taken in the process (see processLock), for as
+// long as that takes, and LockTimeout is only for other processes.
+
+// LockTimeout is how long to wait for a lock before returning ErrLockTimeout
+var LockTimeout = 30 * time.Second
+
+// ErrLockTimeout is returned when a lock is not acquired within LockTimeout
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// lockPollInterval is how often a held lock is tried again
+var lockPollInterval = 50 * time.Millisecond
+
+// LockError is an ErrLockTimeout for the lock file at Path, which was held by
+// the processes Holders (if they could be determined).
+type LockError struct {
+	Path    string
+	Holders []int
+	Err     error
+}
+
+func (e *LockError) Error() string {
+	if len(e.Holders) == 0 {
+		return fmt.Sprintf("%s: %s (%s)", e.Err, e.Path, LockTimeout)
+	}
+	pids := make([]string, len(e.Holders))
+	for i, pid := range e.Holders {
+		pids[i] = fmt.Sprintf("%d", pid)
+		if comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+			pids[i] += " (" + strings.TrimSpace(string(comm)) + ")"
+		}
+	}
+	return fmt.Sprintf("%s: %s (%s), held by pid %s", e.Err, e.Path, LockTimeout, strings.Join(pids, ", "))
+}
+
+// Lock is a held flock(2)
+type Lock struct {
+	fh    *os.File
+	local *sync.Mutex // the processLock of an exclusive lock
+}
+
+// Unlock releases the lock
+func (lk *Lock) Unlock() error {
+	if lk == nil || lk.fh == nil {
+		return nil
+	}
+	defer func() { lk.fh = nil }()
+	if lk.local != nil {
+		defer lk.local.Unlock()
+	}
+	if err := unix.Flock(int(lk.fh.Fd()), unix.LOCK_UN); err != nil {
+		lk.fh.Close()
+		return err
+	}
+	return lk.fh.Close()
+}
+
+var (
+	processLocksMu sync.Mutex
+	processLocks   = map[string]*sync.Mutex{}
+)
+
+// processLock is the mutex of this process for the lock file at path
+func processLock(path string) *sync.Mutex {
+	processLocksMu.Lock()
+	defer processLocksMu.Unlock()
+	mu, ok := processLocks[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		processLocks[path] = mu
+	}
+	return mu
+}
+
+// lockFile takes the flock on path, shared or exclusive, waiting up to
+// LockTimeout for another process holding it. An exclusive lock held in this
+// process is waited for however long it is held. The lock file is created if
+// need be.
+func lockFile(path string, exclusive bool) (lk *Lock, err error) {
+	var local *sync.Mutex
+	if exclusive {
+		local = processLock(path)
+		local.Lock()
+		defer func() {
+			if err != nil {
+				local.Unlock()
+			}
+		}()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		err := unix.Flock(int(fh.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			return &Lock{fh: fh, local: local}, nil
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			fh.Close()
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if time.Now().After(deadline) {
+			holders := lockHolders(fh)
+			fh.Close()
+			return nil, &LockError{Path: path, Holders: holders, Err: ErrLockTimeout}
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockHolders finds the processes holding a flock on the file of fh, from
+// /proc/locks. Only the pid that took each lock is known there.
+func lockHolders(fh *os.File) []int {
+	info, err := fh.Stat()
+	if err != nil {
+		return nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	// like "1: FLOCK  ADVISORY  WRITE 1234 fd:01:5678 0 EOF"
+	file := fmt.Sprintf("%02x:%02x:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)), st.Ino)
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return nil
+	}
+	defer locks.Close()
+	holders := []int{}
+	s := bufio.NewScanner(locks)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != file {
+			continue
+		}
+		var pid int
+		if _, err := fmt.Sscanf(fields[4], "%d", &pid); err == nil {
+			holders = append(holders, pid)
+		}
+	}
+	return holders
+}
+
+// LockStore takes the lock of the whole extracts directory at rootpath.
+// Extracting holds it shared, and removing from the store holds it exclusive.
+func LockStore(rootpath string, exclusive bool) (*Lock, error) {
+	return lockFile(filepath.Join(rootpath, nameLocks, nameStoreLock), exclusive)
+}
+
+func (l Layout) lockChainID(hashName, sum string) (*Lock, error) {
+	path, err := l.chainIDLockPath(hashName, sum)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(path, true)
+}
+
+func (l Layout) chainIDLockPath(hashName, sum string) (string, error) {
+	return l.shardedPath(filepath.Join(nameLocks, nameChainID), hashName, sum)
+}
+
+func (l Layout) lockLayer(hashName, sum string) (*Lock, error) {
+	path, err := l.shardedPath(filepath.Join(nameLocks, nameLayers), hashName, sum)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(path, true)
+}
+
+func (l Layout) lockRef(ref string) (*Lock, error) {
+	return lockFile(l.refLockPath(ref), true)
+}
+
+func (l Layout) refLockPath(ref string) string {
+	return filepath.Join(l.Root, nameLocks, nameNames, l.Name, escapeRef(ref)+lockSuffix)
+}
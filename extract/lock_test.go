@@ -0,0 +1,100 @@
+package extract
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lock.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { LockTimeout = d }(LockTimeout)
+	LockTimeout = 200 * time.Millisecond
+
+	// extractions share the store
+	shared, err := LockStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	another, err := LockStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := another.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// but removing from it waits for them
+	_, err = LockStore(dir, true)
+	lerr, ok := err.(*LockError)
+	if !ok || lerr.Err != ErrLockTimeout {
+		t.Fatalf("expected %q; got %v", ErrLockTimeout, err)
+	}
+	found := false
+	for _, pid := range lerr.Holders {
+		if pid == os.Getpid() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected pid %d to be reported holding the lock; got %v", os.Getpid(), lerr.Holders)
+	}
+
+	if err := shared.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	exclusive, err := LockStore(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exclusive.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockInProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lock.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { LockTimeout = d }(LockTimeout)
+	LockTimeout = 100 * time.Millisecond
+	el := Layout{Root: dir, Name: "example.com/app"}
+	sum := "3342106d17cf8fc913c462a27e792c09780fac1a34075098f8180398294c976a"
+
+	// like a worker applying a slow layer
+	held, err := el.lockLayer("sha256", sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(3 * LockTimeout)
+		held.Unlock()
+	}()
+	// another worker waits for it, past LockTimeout
+	lk, err := el.lockLayer("sha256", sum)
+	if err != nil {
+		t.Fatalf("expected to wait for the lock held in this process; got %v", err)
+	}
+	defer lk.Unlock()
+
+	// but not for another process
+	path, err := el.shardedPath(filepath.Join(nameLocks, nameLayers), "sha256", sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.LookPath("flock"); err != nil {
+		t.Skip("flock(1) is not installed")
+	}
+	if err := exec.Command("flock", "-n", path, "true").Run(); err == nil {
+		t.Error("expected another process to not get the lock")
+	}
+}
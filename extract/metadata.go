@@ -0,0 +1,105 @@
+package extract
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// MetadataError is metadata of a layer's entry that could not be applied
+type MetadataError struct {
+	Path string // of the entry, in the layer
+	Op   string // like "chown", or "setxattr security.capability"
+	Err  error
+}
+
+func (e MetadataError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Path, e.Op, e.Err)
+}
+
+// paxSchilyXattr is the prefix of the PAX records of xattrs, as written by
+// GNU tar and bsdtar (e.g. "SCHILY.xattr.security.capability")
+const paxSchilyXattr = "SCHILY.xattr."
+
+// entryXattrs are the xattrs of hdr, from its PAX records
+func entryXattrs(hdr *tar.Header) map[string]string {
+	xattrs := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, paxSchilyXattr) {
+			xattrs[strings.TrimPrefix(k, paxSchilyXattr)] = v
+		}
+	}
+	return xattrs
+}
+
+// isSparse is whether hdr is of a sparse file, in either the old GNU format or
+// the GNU PAX one. Either way, archive/tar reads its holes as NULs.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseBlock is the size of the runs of NULs that are left as holes
+const sparseBlock = 4096
+
+// copySparse copies r to fh, seeking over the blocks of NULs so that they are
+// holes rather than written, and then sizes fh to size.
+func copySparse(fh *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, sparseBlock)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZeros(buf[:n]) {
+				if _, err := fh.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := fh.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// for a hole at the end
+	return fh.Truncate(size)
+}
+
+func isZeros(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// setDirTimes sets the times of the directory entries dirs, which is left
+// until all of a layer's entries are created (and whiteouts removed), as each
+// changes the mtime of its directory.
+func (r *rootDir) setDirTimes(dirs []*tar.Header, result *LayerResult) {
+	for _, hdr := range dirs {
+		dirfd, name, err := r.openParent(hdr.Name, false)
+		if err == nil {
+			ts := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+			err = unix.UtimesNanoAt(dirfd, name, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+			unix.Close(dirfd)
+		}
+		if err != nil {
+			result.Metadata = append(result.Metadata, MetadataError{Path: hdr.Name, Op: "chtimes", Err: err})
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+// makeSparseTar is a tar of the one file name in the old GNU sparse format,
+// of size bytes that are all holes but data at offset. archive/tar does not
+// write sparse files, so its header is patched to be one.
+func makeSparseTar(t *testing.T, name string, size, offset int64, data string) []byte {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Format: tar.FormatGNU}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blk := buf.Bytes()
+	blk[156] = tar.TypeGNUSparse
+	// the first entry of the sparse map, and the real size
+	copy(blk[386:398], fmt.Sprintf("%011o\x00", offset))
+	copy(blk[398:410], fmt.Sprintf("%011o\x00", len(data)))
+	copy(blk[483:495], fmt.Sprintf("%011o\x00", size))
+	copy(blk[148:156], "        ")
+	sum := 0
+	for _, b := range blk[:512] {
+		sum += int(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+func TestApplyLayerMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-metadata.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the directory's time is kept, though its entries come after it
+	dirTime := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	layer := makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755, ModTime: dirTime}},
+		tarEntry{hdr: tar.Header{Name: "etc/motd", ModTime: time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)}, body: "slartibartfast\n"},
+		tarEntry{hdr: tar.Header{Name: "etc/issue", Typeflag: tar.TypeSymlink, Linkname: "motd", ModTime: dirTime}},
+	)
+	if _, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(layer), LayerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc", "etc/issue"} {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(dirTime) {
+			t.Errorf("expected the mtime of %s to be %s; got %s", name, dirTime, info.ModTime())
+		}
+	}
+
+	// holes are kept
+	const size = 8 << 20
+	if _, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(makeSparseTar(t, "var/sparse", size, 1<<20, "zaphod\n")), LayerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "var/sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != size || string(buf[1<<20:1<<20+7]) != "zaphod\n" || strings.Trim(string(buf[:1<<20]), "\x00") != "" {
+		t.Errorf("expected the sparse file's content; got %d bytes", len(buf))
+	}
+	info, err := os.Stat(filepath.Join(dir, "var/sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks * 512; blocks >= size {
+		t.Errorf("expected the sparse file to have holes; got %d bytes allocated", blocks)
+	}
+}
+
+func TestApplyLayerXattrs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("file capabilities and trusted xattrs need root")
+	}
+	dir, err := ioutil.TempDir("", "test-metadata.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// VFS_CAP_REVISION_2, with cap_net_raw permitted and effective
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	layer := makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "bin/ping", Mode: 0755, Uid: 1, Gid: 1, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": capability,
+			"SCHILY.xattr.trusted.oci":         "zaphod",
+		}}, body: "#!/bin/sh\n"},
+		tarEntry{hdr: tar.Header{Name: "bin/bogus", PAXRecords: map[string]string{"SCHILY.xattr.bogus.name": "x"}}, body: "\n"},
+	)
+	result, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(layer), LayerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := make([]byte, 64)
+	// set after the chown, which would have cleared it
+	if n, err := syscall.Getxattr(filepath.Join(dir, "bin/ping"), "security.capability", value); err != nil || string(value[:n]) != capability {
+		t.Errorf("expected the file capabilities of bin/ping; got %q (%v)", value[:n], err)
+	}
+	if n, err := syscall.Getxattr(filepath.Join(dir, "bin/ping"), "trusted.oci", value); err != nil || string(value[:n]) != "zaphod" {
+		t.Errorf("expected the trusted.oci xattr of bin/ping; got %q (%v)", value[:n], err)
+	}
+
+	// what could not be set is reported, or fails the layer with StrictMetadata
+	if len(result.Metadata) != 1 || result.Metadata[0].Path != "bin/bogus" || result.Metadata[0].Op != "setxattr bogus.name" {
+		t.Errorf("expected the bogus xattr to fail; got %v", result.Metadata)
+	}
+	_, err = ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(layer), LayerOptions{StrictMetadata: true})
+	if merr, ok := err.(MetadataError); !ok || merr.Path != "bin/bogus" {
+		t.Errorf("expected a MetadataError for bin/bogus; got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package extract
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootDir resolves the paths of a layer's entries within the directory it is
+// applied to. Symlinks in it are followed as if it were the root (so `/usr`
+// is its "usr"), but never out of it, so that a layer can not write through a
+// symlink (like `etc -> /`) onto the host. Each directory is descended with
+// openat(2) and O_NOFOLLOW, rather than resolving the path as a whole.
+type rootDir struct {
+	path string
+	fd   int
+}
+
+// maxSymlinks is how many symlinks are followed resolving one path, like the
+// kernel's limit before ELOOP
+const maxSymlinks = 40
+
+func openRoot(path string) (*rootDir, error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return &rootDir{path: path, fd: fd}, nil
+}
+
+func (r *rootDir) Close() error {
+	return unix.Close(r.fd)
+}
+
+// openParent opens the directory that the entry name is in, and returns it
+// with the last element of name. With create, missing directories are made
+// (mode 0755, until their own entry sets it). Like in a chroot, `..` of the
+// root is the root. ErrPathEscapes is returned if name itself is `..`. The
+// caller closes the returned fd.
+func (r *rootDir) openParent(name string, create bool) (int, string, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		parts = []string{"."}
+	}
+	if last := parts[len(parts)-1]; last == ".." {
+		return -1, "", ErrPathEscapes
+	}
+
+	resolved := []string{}
+	dirfd, err := r.openResolved(resolved)
+	if err != nil {
+		return -1, "", err
+	}
+	links := 0
+	// the last element is never followed, it is what the entry is
+	for len(parts) > 1 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				continue
+			}
+			resolved = resolved[:len(resolved)-1]
+			unix.Close(dirfd)
+			if dirfd, err = r.openResolved(resolved); err != nil {
+				return -1, "", err
+			}
+			continue
+		}
+
+		var st unix.Stat_t
+		err := unix.Fstatat(dirfd, part, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == unix.ENOENT && create {
+			if err := unix.Mkdirat(dirfd, part, 0755); err != nil && err != unix.EEXIST {
+				unix.Close(dirfd)
+				return -1, "", r.pathError("mkdir", resolved, part, err)
+			}
+			err = unix.Fstatat(dirfd, part, &st, unix.AT_SYMLINK_NOFOLLOW)
+		}
+		if err != nil {
+			unix.Close(dirfd)
+			return -1, "", r.pathError("stat", resolved, part, err)
+		}
+
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			links++
+			if links > maxSymlinks {
+				unix.Close(dirfd)
+				return -1, "", r.pathError("open", resolved, part, unix.ELOOP)
+			}
+			target, err := readlinkat(dirfd, part)
+			if err != nil {
+				unix.Close(dirfd)
+				return -1, "", r.pathError("readlink", resolved, part, err)
+			}
+			if filepath.IsAbs(target) {
+				resolved = resolved[:0]
+				unix.Close(dirfd)
+				if dirfd, err = r.openResolved(resolved); err != nil {
+					return -1, "", err
+				}
+			}
+			parts = append(splitPath(target), parts...)
+			continue
+		}
+
+		fd, err := unix.Openat(dirfd, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(dirfd)
+		if err != nil {
+			return -1, "", r.pathError("open", resolved, part, err)
+		}
+		dirfd = fd
+		resolved = append(resolved, part)
+	}
+	return dirfd, parts[0], nil
+}
+
+// openResolved opens the directory of the already resolved elements, which
+// are only directories
+func (r *rootDir) openResolved(resolved []string) (int, error) {
+	dirfd, err := unix.Openat(r.fd, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: r.path, Err: err}
+	}
+	for i, part := range resolved {
+		fd, err := unix.Openat(dirfd, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(dirfd)
+		if err != nil {
+			return -1, r.pathError("open", resolved[:i], part, err)
+		}
+		dirfd = fd
+	}
+	return dirfd, nil
+}
+
+func (r *rootDir) pathError(op string, resolved []string, part string, err error) error {
+	return &os.PathError{Op: op, Path: filepath.Join(r.path, filepath.Join(resolved...), part), Err: err}
+}
+
+// splitPath is the elements of the path name, without the empty ones
+func splitPath(name string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(name, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func readlinkat(dirfd int, name string) (string, error) {
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// fdPath is a path to name in the directory dirfd, for the calls that have no
+// *at(2) variant (like the xattr ones). Only the /proc link of dirfd is
+// followed, so name must be a single element.
+func fdPath(dirfd int, name string) string {
+	return fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, name)
+}
@@ -0,0 +1,286 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+// TestApplyLayerMalicious is a corpus of layers that attempt to write outside
+// of the directory they are applied to. Each is applied to "rootfs", next to
+// "outside", which has a file "secret" that must not change.
+func TestApplyLayerMalicious(t *testing.T) {
+	cases := []struct {
+		name    string
+		layers  func(outside string) [][]tarEntry
+		overlay bool
+		fails   bool
+		check   func(t *testing.T, rootfs string)
+	}{
+		{
+			name: "write through an absolute symlink",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{{
+					{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: outside}},
+					{hdr: tar.Header{Name: "etc/secret"}, body: "pwned\n"},
+				}}
+			},
+			check: func(t *testing.T, rootfs string) {
+				// it is followed as if rootfs were the root
+				if _, err := os.Stat(filepath.Join(rootfs, rootfs, "..", "outside", "secret")); err != nil {
+					t.Errorf("expected the file in the rootfs; got %v", err)
+				}
+			},
+		},
+		{
+			name: "write through a symlink to the parent, made of two in-root symlinks",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{{
+					{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}},
+					// lexically "a/.." is ".", but it is created as "b -> .."
+					{hdr: tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+					{hdr: tar.Header{Name: "b/outside/secret"}, body: "pwned\n"},
+				}}
+			},
+		},
+		{
+			name: "write through a symlink from a lower layer",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{
+					{{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}},
+						{hdr: tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."}}},
+					{{hdr: tar.Header{Name: "b/outside/new"}, body: "pwned\n"}},
+				}
+			},
+		},
+		{
+			name: "replace a symlink to a file outside",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{
+					{{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}},
+						{hdr: tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: "../outside/secret"}}},
+					{{hdr: tar.Header{Name: "b", Mode: 0777}, body: "pwned\n"}},
+				}
+			},
+			check: func(t *testing.T, rootfs string) {
+				if info, err := os.Lstat(filepath.Join(rootfs, "b")); err != nil || !info.Mode().IsRegular() {
+					t.Errorf("expected b to be replaced by a file; got %v", err)
+				}
+			},
+		},
+		{
+			name: "chmod a directory through a symlink",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{
+					{{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: outside}}},
+					{{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0777}}},
+				}
+			},
+			check: func(t *testing.T, rootfs string) {
+				if info, err := os.Lstat(filepath.Join(rootfs, "etc")); err != nil || !info.IsDir() {
+					t.Errorf("expected etc to be replaced by a directory; got %v", err)
+				}
+			},
+		},
+		{
+			name: "hardlink to a file outside",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{{
+					{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}},
+					{hdr: tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+					{hdr: tar.Header{Name: "secret", Typeflag: tar.TypeLink, Linkname: "b/outside/secret"}},
+				}}
+			},
+			check: func(t *testing.T, rootfs string) {
+				if _, err := os.Lstat(filepath.Join(rootfs, "secret")); !os.IsNotExist(err) {
+					t.Errorf("expected no hardlink; got %v", err)
+				}
+			},
+		},
+		{
+			name: "hardlink through an absolute symlink",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{{
+					{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: outside}},
+					{hdr: tar.Header{Name: "secret", Typeflag: tar.TypeLink, Linkname: "etc/secret"}},
+				}}
+			},
+		},
+		{
+			name: "whiteout through a symlink",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{
+					{{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}},
+						{hdr: tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+						{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: outside}}},
+					{{hdr: tar.Header{Name: "b/outside/.wh.secret"}},
+						{hdr: tar.Header{Name: "etc/.wh.secret"}},
+						{hdr: tar.Header{Name: "b/outside/.wh..wh..opq"}}},
+				}
+			},
+		},
+		{
+			name:    "overlay whiteout through a symlink",
+			overlay: true,
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{{
+					{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."}},
+					{hdr: tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+					{hdr: tar.Header{Name: "b/outside/.wh.secret"}},
+					{hdr: tar.Header{Name: "b/outside/.wh..wh..opq"}},
+				}}
+			},
+		},
+		{
+			name: "parent directory in the entry name",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{{
+					{hdr: tar.Header{Name: "../outside/secret"}, body: "pwned\n"},
+					{hdr: tar.Header{Name: "etc/../../outside/new"}, body: "pwned\n"},
+				}}
+			},
+		},
+		{
+			name: "symlink loop",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{{
+					{hdr: tar.Header{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"}},
+					{hdr: tar.Header{Name: "loop/file"}, body: "pwned\n"},
+				}}
+			},
+			fails: true,
+		},
+		{
+			name: "symlinks within the rootfs are followed",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{
+					{{hdr: tar.Header{Name: "usr/lib", Typeflag: tar.TypeDir, Mode: 0755}},
+						{hdr: tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"}},
+						{hdr: tar.Header{Name: "lib64", Typeflag: tar.TypeSymlink, Linkname: "/usr/lib"}},
+						{hdr: tar.Header{Name: "usr/lib/up", Typeflag: tar.TypeSymlink, Linkname: "../../usr"}}},
+					{{hdr: tar.Header{Name: "lib/libc.so"}, body: "libc\n"},
+						{hdr: tar.Header{Name: "lib64/ld.so"}, body: "ld\n"},
+						{hdr: tar.Header{Name: "lib/up/lib/libm.so"}, body: "libm\n"}},
+				}
+			},
+			check: func(t *testing.T, rootfs string) {
+				for _, name := range []string{"usr/lib/libc.so", "usr/lib/ld.so", "usr/lib/libm.so"} {
+					if info, err := os.Lstat(filepath.Join(rootfs, name)); err != nil || !info.Mode().IsRegular() {
+						t.Errorf("expected %s to be a file; got %v", name, err)
+					}
+				}
+			},
+		},
+		{
+			name: "relative symlinks up to the root are kept",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{
+					{{hdr: tar.Header{Name: "usr/lib", Typeflag: tar.TypeDir, Mode: 0755}},
+						{hdr: tar.Header{Name: "usr/bin", Typeflag: tar.TypeDir, Mode: 0755}},
+						{hdr: tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib"}},
+						{hdr: tar.Header{Name: "usr/sbin", Typeflag: tar.TypeSymlink, Linkname: "../../../usr/bin"}}},
+					{{hdr: tar.Header{Name: "lib/libc.so"}, body: "libc\n"},
+						{hdr: tar.Header{Name: "usr/sbin/init"}, body: "init\n"}},
+				}
+			},
+			check: func(t *testing.T, rootfs string) {
+				// `..` of the root is the root, as when the rootfs is used
+				for name, target := range map[string]string{"lib": "../usr/lib", "usr/sbin": "../../../usr/bin"} {
+					if link, err := os.Readlink(filepath.Join(rootfs, name)); err != nil || link != target {
+						t.Errorf("expected %s -> %s; got %q (%v)", name, target, link, err)
+					}
+				}
+				for _, name := range []string{"usr/lib/libc.so", "usr/bin/init"} {
+					if info, err := os.Lstat(filepath.Join(rootfs, name)); err != nil || !info.Mode().IsRegular() {
+						t.Errorf("expected %s to be a file; got %v", name, err)
+					}
+				}
+			},
+		},
+		{
+			name: "replace a directory that is not empty",
+			layers: func(outside string) [][]tarEntry {
+				return [][]tarEntry{
+					{{hdr: tar.Header{Name: "opt/thing/a"}, body: "lower\n"},
+						{hdr: tar.Header{Name: "opt/thing/sub/out", Typeflag: tar.TypeSymlink, Linkname: outside}},
+						{hdr: tar.Header{Name: "opt/other/sub/b"}, body: "lower\n"}},
+					{{hdr: tar.Header{Name: "opt/thing"}, body: "upper\n"},
+						{hdr: tar.Header{Name: "opt/other", Typeflag: tar.TypeSymlink, Linkname: "thing"}}},
+				}
+			},
+			check: func(t *testing.T, rootfs string) {
+				if buf, err := ioutil.ReadFile(filepath.Join(rootfs, "opt/thing")); err != nil || string(buf) != "upper\n" {
+					t.Errorf("expected opt/thing to be replaced by a file; got %q (%v)", buf, err)
+				}
+				if link, err := os.Readlink(filepath.Join(rootfs, "opt/other")); err != nil || link != "thing" {
+					t.Errorf("expected opt/other to be replaced by a symlink; got %q (%v)", link, err)
+				}
+			},
+		},
+	}
+
+	for _, c := range cases {
+		if c.overlay && os.Geteuid() != 0 {
+			// overlay whiteouts are made with mknod and trusted.* xattrs
+			t.Logf("%s: skipped, as it needs root", c.name)
+			continue
+		}
+		dir, err := ioutil.TempDir("", "test-malicious.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		rootfs := filepath.Join(dir, "rootfs")
+		outside := filepath.Join(dir, "outside")
+		if err := os.Mkdir(outside, 0700); err != nil {
+			t.Fatal(err)
+		}
+		secret := filepath.Join(outside, "secret")
+		if err := ioutil.WriteFile(secret, []byte("secret\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		var applyErr error
+		for _, entries := range c.layers(outside) {
+			_, applyErr = ApplyLayer(rootfs, layout.MediaTypeImageLayerTar, bytes.NewReader(makeTar(t, entries...)), LayerOptions{Overlay: c.overlay})
+			if applyErr != nil {
+				break
+			}
+		}
+		if c.fails && applyErr == nil {
+			t.Errorf("%s: expected an error", c.name)
+		} else if !c.fails && applyErr != nil {
+			t.Errorf("%s: %s", c.name, applyErr)
+		}
+
+		// nothing outside of the rootfs is changed
+		entries, err := ioutil.ReadDir(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "secret" {
+			t.Errorf("%s: expected only the secret outside; got %d entries", c.name, len(entries))
+		}
+		if info, err := os.Stat(outside); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		} else if info.Mode().Perm() != 0700 {
+			t.Errorf("%s: expected the mode of outside to be unchanged; got %s", c.name, info.Mode())
+		}
+		info, err := os.Stat(secret)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		buf, err := ioutil.ReadFile(secret)
+		if err != nil || string(buf) != "secret\n" || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected the secret to be unchanged; got %q (%s)", c.name, buf, info.Mode())
+		}
+		if c.check != nil {
+			c.check(t, rootfs)
+		}
+	}
+}
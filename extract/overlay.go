@@ -0,0 +1,267 @@
+package extract
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+	"github.com/vbatts/oci-systemd-generator/util"
+	"golang.org/x/sys/unix"
+)
+
+// With StorageOverlay, the layers are applied to `layers/<hashName>/<shard>/<sum>`
+// (marked complete the same as chainID directories), and the ref's rootfs
+// links to `overlays/<hashName>/<shard>/<chainID sum>`, a file of the layers
+// of that chainID. Each ref has its own merged directory in
+// `names/<name>/<ref>/overlay/`, and each of its generations its own upper and
+// work directories, so that what the service wrote on one image does not
+// shadow the layers of the next.
+
+// overlayLayers is the content of a file under "overlays"
+type overlayLayers struct {
+	Lower []string `json:"lower"` // layer directories, from the base up
+}
+
+func readOverlayLayers(path string) (*overlayLayers, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	layers := overlayLayers{}
+	if err := json.Unmarshal(buf, &layers); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &layers, nil
+}
+
+// overlayComplete is whether the file of layers at path, and all of its
+// layers, are extracted.
+func overlayComplete(path string) bool {
+	layers, err := readOverlayLayers(path)
+	if err != nil {
+		return false
+	}
+	for _, lower := range layers.Lower {
+		if !chainIDComplete(lower) {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaySnapshotter is the Snapshotter of StorageOverlay. Its snapshots are
+// the files of layers under "overlays", and each layer is applied on its own.
+type overlaySnapshotter struct {
+	l Layout
+}
+
+func (s *overlaySnapshotter) Path(chainID *layout.DigestRef) (string, error) {
+	return s.l.shardedPath(nameOverlays, chainID.HashName(), chainID.Sum())
+}
+
+func (s *overlaySnapshotter) Committed(path string) bool {
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return overlayComplete(path)
+}
+
+// Prepare always applies from the first layer, as layers already in the
+// "layers" directory are not applied again anyway.
+func (s *overlaySnapshotter) Prepare(chainIDs []*layout.DigestRef) (Active, int, error) {
+	destpath, err := s.Path(chainIDs[len(chainIDs)-1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return &overlayActive{l: s.l, destpath: destpath, layers: overlayLayers{Lower: []string{}}}, 0, nil
+}
+
+func (s *overlaySnapshotter) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// maxOverlayLayers is the most lowerdirs overlayfs stacks (its
+// OVL_MAX_STACK)
+const maxOverlayLayers = 500
+
+// Mounts is the overlayfs mount of the layers at path, with the upper and work
+// directories of the ref's current generation (or of the ref, if it has no
+// generations) and the ref's merged directory, which are created if need be.
+// The mount options must fit in a page, which the kernel copies them into, so
+// a rootfs of too many layers fails here rather than when it is mounted.
+func (s *overlaySnapshotter) Mounts(path string, ref *Ref) (*Mount, error) {
+	layers, err := readOverlayLayers(path)
+	if err != nil {
+		return nil, err
+	}
+	upper, work := s.l.overlayPath(ref.Name, nameUpper), s.l.overlayPath(ref.Name, nameWork)
+	if g, err := ref.CurrentGeneration(); err == nil {
+		genPath := s.l.generationPath(ref.Name, g.Number)
+		upper, work = filepath.Join(genPath, nameUpper), filepath.Join(genPath, nameWork)
+	} else if err != ErrNoGeneration {
+		return nil, err
+	}
+	merged := s.l.overlayPath(ref.Name, nameMerged)
+
+	// lowerdir is from the top most layer down
+	lower := make([]string, len(layers.Lower))
+	for i, dir := range layers.Lower {
+		lower[len(layers.Lower)-1-i] = dir
+	}
+	mnt := &Mount{
+		Type:   "overlay",
+		Source: "overlay",
+		Options: []string{
+			"lowerdir=" + strings.Join(lower, ":"),
+			"upperdir=" + upper,
+			"workdir=" + work,
+		},
+		Where: merged,
+	}
+	if len(lower) > maxOverlayLayers {
+		return nil, fmt.Errorf("%s/%s: %d layers are more than overlayfs stacks (%d)", s.l.Name, ref.Name, len(lower), maxOverlayLayers)
+	}
+	if size := len(strings.Join(mnt.Options, ",")); size >= os.Getpagesize() {
+		return nil, fmt.Errorf("%s/%s: the overlay mount options of its %d layers are %d bytes, more than fit in a page (%d)", s.l.Name, ref.Name, len(lower), size, os.Getpagesize()-1)
+	}
+
+	for _, dir := range []string{upper, work, merged} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return mnt, nil
+}
+
+// overlayActive collects the layers of a file of layers being prepared
+type overlayActive struct {
+	l        Layout
+	destpath string
+	layers   overlayLayers
+}
+
+// Apply applies the layer of diffID on its own to the "layers" directory,
+// unless it is already there.
+func (a *overlayActive) Apply(diffID *layout.DigestRef, apply func(dir string, opts LayerOptions) error) error {
+	if err := diffID.Validate(); err != nil {
+		return fmt.Errorf("diff_id %q: %s", diffID.Name, err)
+	}
+	layerPath, err := a.l.layerPath(diffID.HashName(), diffID.Sum())
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(layerPath, ":,") {
+		return fmt.Errorf("%q can not be an overlayfs lowerdir", layerPath)
+	}
+
+	lock, err := a.l.lockLayer(diffID.HashName(), diffID.Sum())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if chainIDComplete(layerPath) {
+		util.Debugf("layer %q already exists. Not applying.", diffID.Name)
+		a.layers.Lower = append(a.layers.Lower, layerPath)
+		return nil
+	}
+	if err := removeChainID(layerPath); err != nil {
+		return err
+	}
+
+	tmp, err := a.l.tmpPath()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	staging := filepath.Join(tmp, nameLayers)
+	if err := os.Mkdir(staging, 0755); err != nil {
+		return err
+	}
+	if err := apply(staging, LayerOptions{Overlay: true}); err != nil {
+		return err
+	}
+
+	if err := syncfs(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(layerPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, layerPath); err != nil {
+		return err
+	}
+	if err := markComplete(layerPath); err != nil {
+		return err
+	}
+	a.layers.Lower = append(a.layers.Lower, layerPath)
+	return nil
+}
+
+// Commit writes the file of the layers
+func (a *overlayActive) Commit() error {
+	if len(a.layers.Lower) == 0 {
+		return fmt.Errorf("no layers to mount for %q", a.destpath)
+	}
+	buf, err := json.Marshal(a.layers)
+	if err != nil {
+		return err
+	}
+	tmp, err := a.l.tmpPath()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, nameOverlays), buf, 0644); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.destpath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(tmp, nameOverlays), a.destpath)
+}
+
+// Abort leaves the layers applied so far, as each is complete on its own
+func (a *overlayActive) Abort() error {
+	return nil
+}
+
+// overlayWhiteout translates the whiteout entry name to an overlayfs whiteout
+// in the root. What the layer itself wrote at its path is kept, and as it
+// replaces the lower layers' entry, a directory is made opaque.
+func (r *rootDir) overlayWhiteout(name string, paths layerPaths) error {
+	if filepath.Base(name) == whiteoutPrefix+whiteoutPrefix+".opq" {
+		// the directory of the entry is what is opaque
+		dirfd, _, err := r.openParent(name, true)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(dirfd)
+		return unix.Lsetxattr(fdPath(dirfd, "."), overlayOpaqueXattr, []byte("y"), 0)
+	}
+	path := pathFromWhiteout(name)
+	if path == "" {
+		return nil
+	}
+	dirfd, base, err := r.openParent(path, true)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	if paths.has(path) {
+		var st unix.Stat_t
+		if err := unix.Fstatat(dirfd, base, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil && st.Mode&unix.S_IFMT == unix.S_IFDIR {
+			return unix.Lsetxattr(fdPath(dirfd, base), overlayOpaqueXattr, []byte("y"), 0)
+		}
+		return nil
+	}
+	return unix.Mknodat(dirfd, base, unix.S_IFCHR, 0)
+}
+
+var overlayOpaqueXattr = "trusted.overlay.opaque"
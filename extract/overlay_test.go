@@ -0,0 +1,147 @@
+package extract
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+func TestExtractOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("overlay whiteouts need root")
+	}
+	defer func(s Storage) { DefaultStorage = s }(DefaultStorage)
+	DefaultStorage = StorageOverlay
+
+	dir, err := ioutil.TempDir("", "test-overlay.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	base := makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"},
+		tarEntry{hdr: tar.Header{Name: "var/cache/apt/pkgcache.bin"}, body: "zaphod\n"},
+	)
+	top := makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "etc/.wh.motd"}},
+		tarEntry{hdr: tar.Header{Name: "var/cache/.wh..wh..opq"}},
+		tarEntry{hdr: tar.Header{Name: "bin/true", Mode: 0755}, body: "#!/bin/sh\n"},
+	)
+	m := newImage(t, layouts, "example.com/app", base, top)
+	m.Ref = "latest"
+
+	el, err := Extract(extracts, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := Ref{Name: "latest", Layout: el}
+	mnt, err := ref.Mount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mnt.Type != "overlay" || len(mnt.Options) != 3 || !strings.HasPrefix(mnt.Options[0], "lowerdir=") {
+		t.Fatalf("expected an overlay mount; got %#v", mnt)
+	}
+	lower := strings.Split(strings.TrimPrefix(mnt.Options[0], "lowerdir="), ":")
+	if len(lower) != 2 {
+		t.Fatalf("expected an overlay mount of 2 layers; got %q", mnt.Options[0])
+	}
+	// the top most layer is first
+	topPath, basePath := lower[0], lower[1]
+	if _, err := os.Stat(filepath.Join(basePath, "etc/motd")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(topPath, "bin/true")); err != nil {
+		t.Error(err)
+	}
+
+	// the whiteouts are for overlayfs, and leave the base layer as it is
+	info, err := os.Lstat(filepath.Join(topPath, "etc/motd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); info.Mode()&os.ModeCharDevice == 0 || st.Rdev != 0 {
+		t.Errorf("expected etc/motd to be a 0/0 character device; got %s", info.Mode())
+	}
+	buf := make([]byte, 1)
+	if n, err := syscall.Getxattr(filepath.Join(topPath, "var/cache"), overlayOpaqueXattr, buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("expected var/cache to be opaque; got %q (%v)", buf, err)
+	}
+	if _, err := os.Stat(filepath.Join(basePath, "var/cache/apt/pkgcache.bin")); err != nil {
+		t.Error(err)
+	}
+
+	upper := filepath.Join(el.generationPath("latest", 1), nameUpper)
+	for _, path := range []string{upper, filepath.Join(el.generationPath("latest", 1), nameWork), mnt.Where} {
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			t.Errorf("expected the directory %q; got %v", path, err)
+		}
+	}
+	if mnt.Options[1] != "upperdir="+upper {
+		t.Errorf("expected the upper directory of the generation; got %q", mnt.Options[1])
+	}
+
+	// what the service wrote does not shadow the layers of the next image
+	if err := ioutil.WriteFile(filepath.Join(upper, "state"), []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next := newImage(t, layouts, "example.com/app", base, makeTar(t, tarEntry{hdr: tar.Header{Name: "state"}, body: "new\n"}))
+	next.Ref = "latest"
+	if _, err := Extract(extracts, next); err != nil {
+		t.Fatal(err)
+	}
+	nextMnt, err := ref.Mount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextUpper := strings.TrimPrefix(nextMnt.Options[1], "upperdir=")
+	if nextUpper == upper || nextMnt.Where != mnt.Where {
+		t.Errorf("expected a new upper directory, at the same mount point; got %#v", nextMnt)
+	}
+	if _, err := os.Stat(filepath.Join(nextUpper, "state")); !os.IsNotExist(err) {
+		t.Errorf("expected the new upper directory to be empty; got %v", err)
+	}
+
+	// a rootfs of more layers than fit in the mount options fails
+	lowers := overlayLayers{}
+	for i := 0; i < 64; i++ {
+		lowers.Lower = append(lowers.Lower, filepath.Join(extracts, nameLayers, "sha256", strings.Repeat("0", 64)))
+	}
+	buf, err = json.Marshal(lowers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooMany := filepath.Join(dir, "too-many")
+	if err := ioutil.WriteFile(tooMany, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&overlaySnapshotter{l: *el}).Mounts(tooMany, &ref); err == nil {
+		t.Error("expected the mount options of too many layers to fail")
+	}
+
+	// the layers are kept for as long as a ref uses them
+	result, err := GC(extracts, layout.Layouts{"example.com/app": &layout.Layout{Root: layouts, Name: "example.com/app"}}, GCOptions{KeepOrphans: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Layers) != 0 || len(result.ChainIDs) != 0 {
+		t.Errorf("expected nothing to be collected; got %v", result)
+	}
+	result, err = GC(extracts, layout.Layouts{}, GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Layers) != 3 || len(result.ChainIDs) != 2 {
+		t.Errorf("expected the 3 layers and 2 overlays of the orphaned ref to be collected; got %v", result)
+	}
+}
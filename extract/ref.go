@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/oci-systemd-generator/layout"
+	"github.com/vbatts/oci-systemd-generator/util"
 )
 
 // Ref is the ref of an extracted OCI image layout.
@@ -25,6 +28,61 @@ func (r Ref) ConfigReader() (io.ReadCloser, error) {
 	return os.Open(r.Layout.refPath(r.Name))
 }
 
+// ConfigDigest is the digest of the OCI image config for this extracted
+// layout, as addressed in the configs directory.
+func (r Ref) ConfigDigest() (string, error) {
+	return configDigest(r.Layout.refPath(r.Name))
+}
+
+// HasConfig is whether the OCI image config for this extracted layout is the
+// one of digest. When digest is of a different hash than the configs
+// directory, the config is summed with that hash.
+func (r Ref) HasConfig(digest string) (bool, error) {
+	return hasConfig(r.Layout.refPath(r.Name), digest)
+}
+
+// configDigest is the digest of the config that the symlink at path links to
+func configDigest(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	return pathDigest(target), nil
+}
+
+// pathDigest is the digest of a content addressed path, like
+// `.../configs/<hashName>/<shard>/<sum>`
+func pathDigest(path string) string {
+	hashName := filepath.Base(filepath.Dir(filepath.Dir(path)))
+	return hashName + ":" + filepath.Base(path)
+}
+
+// hasConfig is whether the symlink at path links to the config of digest
+func hasConfig(path, digest string) (bool, error) {
+	current, err := configDigest(path)
+	if err != nil {
+		return false, err
+	}
+	if current == digest {
+		return true, nil
+	}
+	want := layout.DigestRef{Name: digest}
+	have := layout.DigestRef{Name: current}
+	if want.HashName() == have.HashName() {
+		return false, nil
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+	sum, err := util.SumContent(want.HashName(), fh)
+	if err != nil {
+		return false, err
+	}
+	return sum == want.Sum(), nil
+}
+
 // Config parses the OCI image config for this particular layout reference
 func (r *Ref) Config() (*Config, error) {
 	configFH, err := r.ConfigReader()
@@ -40,6 +98,27 @@ func (r *Ref) Config() (*Config, error) {
 	return &Config{Layout: r.Layout, Ref: r, ImageConfig: imageConfig}, nil
 }
 
+// Orphaned is whether this extracted ref's image layout, or the ref in it, is
+// not in layouts. A layout whose refs can not be read is presumed to still
+// have it.
+func (r Ref) Orphaned(layouts layout.Layouts) bool {
+	l, ok := layouts[r.Layout.Name]
+	if !ok {
+		return true
+	}
+	refs, err := l.Refs()
+	if err != nil {
+		util.Debugf("%s: %s", r.Layout.Name, err)
+		return false
+	}
+	for _, name := range refs {
+		if name == r.Name {
+			return false
+		}
+	}
+	return true
+}
+
 // RootFS provides the path to this extracted image's root filesystem (at least
 // the symlink to the path).
 func (r Ref) RootFS() string {
@@ -68,7 +147,8 @@ func (r Ref) ReverseDomainNotation() string {
 		basename = strings.Join(chunks, domainDelimiter)
 	}
 	path = strings.Replace(path, pathDelimiter, domainDelimiter, -1)
-	return strings.Join([]string{basename, path, "ref", r.Name}, domainDelimiter)
+	ref := strings.Replace(r.Name, pathDelimiter, domainDelimiter, -1)
+	return strings.Join([]string{basename, path, "ref", ref}, domainDelimiter)
 }
 
 var (
@@ -0,0 +1,216 @@
+package extract
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+	"golang.org/x/sys/unix"
+)
+
+// Rootless is LayerOptions.Rootless for the layers applied by Extract. It is
+// the default when not running as root.
+var Rootless = os.Geteuid() != 0
+
+// rootlessXattr is where the owner of a file is recorded when extracting
+// rootless, per the rootlesscontainers convention
+// (https://rootlesscontaine.rs/proto/rootlesscontainers.proto). Its value is
+// the protobuf encoded message:
+//
+//	message Resource {
+//		uint32 uid = 1;
+//		uint32 gid = 2;
+//	}
+//
+// A file without it is owned by root (0:0).
+const rootlessXattr = "user.rootlesscontainers"
+
+// rootlessResource is the protobuf encoding of the Resource of uid and gid.
+// Like proto3 encodes them, fields of 0 are left out.
+func rootlessResource(uid, gid int) []byte {
+	buf := []byte{}
+	if uid != 0 {
+		buf = appendVarint(append(buf, 1<<3), uint64(uint32(uid)))
+	}
+	if gid != 0 {
+		buf = appendVarint(append(buf, 2<<3), uint64(uint32(gid)))
+	}
+	return buf
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// ErrRootlessResource is when the rootlesscontainers xattr of a file is not a
+// Resource message
+var ErrRootlessResource = errors.New("invalid user.rootlesscontainers xattr")
+
+// RootlessOwner is the owner recorded for the file at path when it was
+// extracted rootless (see LayerOptions.Rootless). A file without the record
+// is owned by root (0:0).
+func RootlessOwner(path string) (uid, gid int, err error) {
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(path, rootlessXattr, buf)
+	if err == unix.ENODATA {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	buf = buf[:n]
+	for len(buf) > 0 {
+		key, n := readVarint(buf)
+		if n == 0 || key&7 != 0 {
+			// only varint fields are expected
+			return 0, 0, ErrRootlessResource
+		}
+		buf = buf[n:]
+		v, n := readVarint(buf)
+		if n == 0 {
+			return 0, 0, ErrRootlessResource
+		}
+		buf = buf[n:]
+		switch key >> 3 {
+		case 1:
+			uid = int(uint32(v))
+		case 2:
+			gid = int(uint32(v))
+		}
+	}
+	return uid, gid, nil
+}
+
+// readVarint returns the varint at the start of buf, and its length (0 if it
+// is not whole)
+func readVarint(buf []byte) (uint64, int) {
+	var v uint64
+	for i, b := range buf {
+		if i == 10 {
+			return 0, 0
+		}
+		v |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// setRootlessOwner records uid and gid as the owner of name in dirfd
+func setRootlessOwner(dirfd int, name string, uid, gid int) error {
+	if uid == 0 && gid == 0 {
+		// it may be of a lower layer's entry, replaced by this one
+		if err := unix.Lremovexattr(fdPath(dirfd, name), rootlessXattr); err != nil && err != unix.ENODATA {
+			return err
+		}
+		return nil
+	}
+	return unix.Lsetxattr(fdPath(dirfd, name), rootlessXattr, rootlessResource(uid, gid), 0)
+}
+
+// The rest of what a rootless extract can not apply as the image has it is
+// recorded in xattrs of its own, as the Resource message only has the owner.
+const (
+	// rootlessModeXattr is the mode of a directory from the image (like "0555"),
+	// when it differs from the mode it was kept writable with
+	rootlessModeXattr = "user.oci-generator.mode"
+
+	// rootlessDeviceXattr marks the empty file in place of a device node, with
+	// its type and numbers (like "c 1 3", as for mknod(1))
+	rootlessDeviceXattr = "user.oci-generator.device"
+)
+
+// Device is a device node of an image that was not created, when extracting
+// rootless. An empty file is in its place (see RootlessDevice).
+type Device struct {
+	Path         string // of the entry in the layer
+	Type         byte   // tar.TypeChar or tar.TypeBlock
+	Major, Minor int64
+}
+
+func (d Device) String() string {
+	return fmt.Sprintf("%s (%s)", d.Path, d.xattr())
+}
+
+// xattr is the value of rootlessDeviceXattr for d
+func (d Device) xattr() string {
+	typ := "c"
+	if d.Type == tar.TypeBlock {
+		typ = "b"
+	}
+	return fmt.Sprintf("%s %d %d", typ, d.Major, d.Minor)
+}
+
+// RootlessDevice is the device node that the file at path is in place of, when
+// it was extracted rootless, or nil if it is not one.
+func RootlessDevice(path string) (*Device, error) {
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(path, rootlessDeviceXattr, buf)
+	if err == unix.ENODATA {
+		return nil, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	d := Device{Path: path}
+	var typ string
+	if _, err := fmt.Sscanf(string(buf[:n]), "%s %d %d", &typ, &d.Major, &d.Minor); err != nil {
+		return nil, fmt.Errorf("%s: invalid %s xattr %q", path, rootlessDeviceXattr, buf[:n])
+	}
+	switch typ {
+	case "c":
+		d.Type = tar.TypeChar
+	case "b":
+		d.Type = tar.TypeBlock
+	default:
+		return nil, fmt.Errorf("%s: invalid %s xattr %q", path, rootlessDeviceXattr, buf[:n])
+	}
+	return &d, nil
+}
+
+// RootlessMode is the mode (permission bits, with setuid, setgid and sticky)
+// of the file at path as the image has it, when it was extracted rootless.
+func RootlessMode(path string) (uint32, error) {
+	buf := make([]byte, 16)
+	n, err := unix.Lgetxattr(path, rootlessModeXattr, buf)
+	if err == nil {
+		mode, err := strconv.ParseUint(string(buf[:n]), 8, 32)
+		if err != nil || mode&^07777 != 0 {
+			return 0, fmt.Errorf("%s: invalid %s xattr %q", path, rootlessModeXattr, buf[:n])
+		}
+		return uint32(mode), nil
+	} else if err != unix.ENODATA {
+		return 0, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return 0, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	return st.Mode & 07777, nil
+}
+
+// setRootlessMode records mode as that of name in dirfd, if it is not what
+// it was applied with
+func setRootlessMode(dirfd int, name string, mode, applied uint32) error {
+	if mode == applied {
+		// it may be of a lower layer's entry, replaced by this one
+		if err := unix.Lremovexattr(fdPath(dirfd, name), rootlessModeXattr); err != nil && err != unix.ENODATA {
+			return err
+		}
+		return nil
+	}
+	return unix.Lsetxattr(fdPath(dirfd, name), rootlessModeXattr, []byte(fmt.Sprintf("%04o", mode)), 0)
+}
+
+// rootlessKey is what the chainID (or diff_id) d is stored as, when extracted
+// rootless. Its files are not owned as the image has them, so it is kept apart
+// from what a root extract of d would use.
+func rootlessKey(d *layout.DigestRef) (*layout.DigestRef, error) {
+	return keyDigest(d, "rootless")
+}
@@ -0,0 +1,204 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+func TestExtractRootlessThenRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("extracting as root needs root")
+	}
+	defer func(rootless bool, s Storage) { Rootless, DefaultStorage = rootless, s }(Rootless, DefaultStorage)
+	DefaultStorage = StorageNaive
+	dir, err := ioutil.TempDir("", "test-rootless.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := syscall.Setxattr(dir, "user.test", []byte("x"), 0); err != nil {
+		t.Skipf("user xattrs are not supported: %s", err)
+	}
+	layouts := filepath.Join(dir, "layouts")
+	extracts := filepath.Join(dir, "extracts")
+
+	// prepared by a build user
+	Rootless = true
+	m := newImage(t, layouts, "example.com/app",
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "usr/bin/su", Mode: 04755, Uid: 1000, Gid: 100}, body: "#!/bin/sh\n"}))
+	m.Ref = "latest"
+	el, err := Extract(extracts, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := Ref{Name: "latest", Layout: el}
+	rootless, err := os.Readlink(ref.RootFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a root run does not adopt it, but extracts it again
+	Rootless = false
+	ne, err := DetermineNotExtracted([]*Layout{el}, []*layout.Manifest{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ne) != 1 {
+		t.Fatalf("expected the rootless extract to be extracted again; got %v", ne)
+	}
+	if _, err := Extract(extracts, m); err != nil {
+		t.Fatal(err)
+	}
+	rootfs, err := os.Readlink(ref.RootFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootfs == rootless {
+		t.Fatalf("expected the root extract to be stored apart from %q", rootless)
+	}
+	info, err := os.Lstat(filepath.Join(rootfs, "usr/bin/su"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 100 || info.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("expected usr/bin/su to be setuid and owned by 1000:100; got %s %d:%d", info.Mode(), st.Uid, st.Gid)
+	}
+}
+
+func TestApplyLayerRootless(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-rootless.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := syscall.Setxattr(dir, "user.test", []byte("x"), 0); err != nil {
+		t.Skipf("user xattrs are not supported: %s", err)
+	}
+
+	if buf := rootlessResource(1000, 100); !bytes.Equal(buf, []byte{0x08, 0xe8, 0x07, 0x10, 0x64}) {
+		t.Errorf("expected the protobuf of 1000:100; got %x", buf)
+	}
+	if buf := rootlessResource(0, 5); !bytes.Equal(buf, []byte{0x10, 0x05}) {
+		t.Errorf("expected the protobuf of 0:5; got %x", buf)
+	}
+
+	opts := LayerOptions{Rootless: true}
+	base := makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "usr", Typeflag: tar.TypeDir, Mode: 0555, Uid: 2, Gid: 2}},
+		tarEntry{hdr: tar.Header{Name: "home/user/.profile", Uid: 1000, Gid: 100}, body: "\n"},
+		tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"},
+		tarEntry{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}},
+	)
+	result, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(base), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	null := Device{Path: "dev/null", Type: tar.TypeChar, Major: 1, Minor: 3}
+	if len(result.Devices) != 1 || result.Devices[0] != null {
+		t.Errorf("expected dev/null to be skipped; got %v", result.Devices)
+	}
+	// an empty file is in its place, recording it
+	if info, err := os.Lstat(filepath.Join(dir, "dev/null")); err != nil || !info.Mode().IsRegular() || info.Size() != 0 {
+		t.Errorf("expected an empty file as dev/null; got %v", err)
+	}
+	dev, err := RootlessDevice(filepath.Join(dir, "dev/null"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev == nil || dev.Type != null.Type || dev.Major != null.Major || dev.Minor != null.Minor {
+		t.Errorf("expected %s to be recorded; got %v", null, dev)
+	}
+	if dev, err := RootlessDevice(filepath.Join(dir, "etc/motd")); dev != nil || err != nil {
+		t.Errorf("expected etc/motd to not be a device; got %v, %v", dev, err)
+	}
+	if len(result.Metadata) != 0 {
+		t.Errorf("expected all the metadata to be applied; got %v", result.Metadata)
+	}
+
+	// a later layer can still write to the read-only directory, and replaces
+	// its owner
+	top := makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "usr", Typeflag: tar.TypeDir, Mode: 0555}},
+		tarEntry{hdr: tar.Header{Name: "usr/bin/true", Mode: 0755, Uid: 3}, body: "#!/bin/sh\n"},
+	)
+	if _, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(top), opts); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "usr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected usr to be kept writable; got %s", info.Mode())
+	}
+	// with the modes the image has recorded
+	for name, expect := range map[string]uint32{"usr": 0555, "usr/bin/true": 0755} {
+		mode, err := RootlessMode(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode != expect {
+			t.Errorf("expected the mode of %s to be %04o; got %04o", name, expect, mode)
+		}
+	}
+
+	for name, owner := range map[string][2]int{
+		"usr":                {0, 0},
+		"usr/bin/true":       {3, 0},
+		"home/user/.profile": {1000, 100},
+		"etc/motd":           {0, 0},
+	} {
+		path := filepath.Join(dir, name)
+		uid, gid, err := RootlessOwner(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid != owner[0] || gid != owner[1] {
+			t.Errorf("expected %s to be recorded as owned by %d:%d; got %d:%d", name, owner[0], owner[1], uid, gid)
+		}
+		// and actually owned by whoever applied the layer
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := info.Sys().(*syscall.Stat_t); int(st.Uid) != os.Geteuid() {
+			t.Errorf("expected %s to be owned by %d; got %d", name, os.Geteuid(), st.Uid)
+		}
+	}
+}
+
+func TestExtractRootlessDevices(t *testing.T) {
+	defer func(rootless bool, s Storage) { Rootless, DefaultStorage = rootless, s }(Rootless, DefaultStorage)
+	Rootless, DefaultStorage = true, StorageNaive
+	dir, err := ioutil.TempDir("", "test-rootless.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := syscall.Setxattr(dir, "user.test", []byte("x"), 0); err != nil {
+		t.Skipf("user xattrs are not supported: %s", err)
+	}
+	m := newImage(t, filepath.Join(dir, "layouts"), "example.com/app",
+		makeTar(t, tarEntry{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}}))
+	m.Ref = "latest"
+
+	// the devices not created are returned with the image's result
+	result := ExtractWithResult(filepath.Join(dir, "extracts"), m)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if len(result.Devices) != 1 || result.Devices[0].Path != "dev/null" {
+		t.Errorf("expected dev/null to not be created; got %v", result.Devices)
+	}
+	results := ExtractAll(filepath.Join(dir, "extracts"), []*layout.Manifest{m}, 1)
+	if results[0].Err != nil || len(results[0].Devices) != 0 {
+		t.Errorf("expected nothing more of the extracted image; got %v, %v", results[0].Err, results[0].Devices)
+	}
+}
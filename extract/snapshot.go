@@ -0,0 +1,265 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+	"github.com/vbatts/oci-systemd-generator/util"
+)
+
+// Snapshotter materializes the root filesystem of a chainID from its layers.
+// It is selected by the "storage" of the configuration (see Snapshotters).
+type Snapshotter interface {
+	// Path is where the snapshot of chainID is once committed. A ref's rootfs
+	// links to it.
+	Path(chainID *layout.DigestRef) (string, error)
+
+	// Committed is whether the snapshot at path is complete, and is of this
+	// Snapshotter.
+	Committed(path string) bool
+
+	// Prepare an active snapshot to apply the layers of chainIDs (one for each
+	// layer) to. It may start from an already committed snapshot of a prefix of
+	// chainIDs, in which case it returns the count of layers it already has.
+	Prepare(chainIDs []*layout.DigestRef) (Active, int, error)
+
+	// Remove the committed snapshot at path
+	Remove(path string) error
+
+	// Mounts is how the snapshot at path is mounted as the rootfs of ref
+	Mounts(path string, ref *Ref) (*Mount, error)
+}
+
+// Active is a snapshot being prepared by a Snapshotter
+type Active interface {
+	// Apply calls apply with the directory to apply the layer of diffID to, and
+	// the options to apply it with. If the Snapshotter already has the layer,
+	// apply is not called.
+	Apply(diffID *layout.DigestRef, apply func(dir string, opts LayerOptions) error) error
+
+	// Commit the snapshot, which is then at the Path of its chainID
+	Commit() error
+
+	// Abort discards the snapshot
+	Abort() error
+}
+
+// Mount is how the rootfs of an extracted ref is mounted (see mount(8)), with
+// Options as they are joined by "," for the Options= of a .mount unit.
+// Without a Type, the rootfs is the directory Where as it is.
+type Mount struct {
+	Type    string
+	Source  string
+	Options []string
+	Where   string
+}
+
+// Storage is the name of a Snapshotter
+type Storage string
+
+const (
+	// StorageNaive applies all the layers of an image to its own chainID
+	// directory, cloned from its longest parent per DefaultCloneMode.
+	StorageNaive Storage = "naive"
+
+	// StorageReflink is StorageNaive, but parents are always cloned with
+	// reflinks (FICLONE), which the filesystem must support (like btrfs or xfs).
+	StorageReflink Storage = "reflink"
+
+	// StorageOverlay stores each layer once (by its diff_id) in the "layers"
+	// directory, and the rootfs is an overlayfs mount of an image's layers.
+	StorageOverlay Storage = "overlay"
+)
+
+// Snapshotters are the available Snapshotter by Storage name
+var Snapshotters = map[Storage]func(l Layout) Snapshotter{
+	StorageNaive:   func(l Layout) Snapshotter { return &naiveSnapshotter{l: l, clone: DefaultCloneMode} },
+	StorageReflink: func(l Layout) Snapshotter { return &naiveSnapshotter{l: l, clone: cloneReflinkOnly} },
+	StorageOverlay: func(l Layout) Snapshotter { return &overlaySnapshotter{l: l} },
+}
+
+// DefaultStorage is the Snapshotter that Extract uses
+var DefaultStorage = StorageNaive
+
+// ParseStorage checks that s is one of the Snapshotters
+func ParseStorage(s string) (Storage, error) {
+	if _, ok := Snapshotters[Storage(s)]; !ok {
+		return "", fmt.Errorf("unknown storage %q", s)
+	}
+	return Storage(s), nil
+}
+
+// snapshotterOf finds the Snapshotter that committed the snapshot at path, as
+// the storage may have been changed since.
+func (l Layout) snapshotterOf(path string) Snapshotter {
+	names := []string{}
+	for name := range Snapshotters {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sn := Snapshotters[Storage(name)](l); sn.Committed(path) {
+			return sn
+		}
+	}
+	return nil
+}
+
+// rootfsComplete is whether the rootfs target is a committed snapshot
+func (l Layout) rootfsComplete(target string) bool {
+	return l.snapshotterOf(target) != nil
+}
+
+// Mount is how this ref's rootfs is mounted
+func (r Ref) Mount() (*Mount, error) {
+	target, err := os.Readlink(r.RootFS())
+	if err != nil {
+		return nil, err
+	}
+	sn := r.Layout.snapshotterOf(target)
+	if sn == nil {
+		return nil, fmt.Errorf("%s/%s: %q is not extracted", r.Layout.Name, r.Name, target)
+	}
+	return sn.Mounts(target, &r)
+}
+
+// snapshotKey is what the chainID (or diff_id) d is stored as, when extracted
+// with idmap and rootless (see IDMap.key and rootlessKey)
+func snapshotKey(d *layout.DigestRef, idmap *IDMap, rootless bool) (*layout.DigestRef, error) {
+	key, err := idmap.key(d)
+	if err != nil || !rootless {
+		return key, err
+	}
+	return rootlessKey(key)
+}
+
+// hasSnapshotKey is whether the rootfs symlink at path links to the snapshot
+// of config's layers extracted with idmap and rootless, whatever its storage
+func hasSnapshotKey(path string, config *layout.Config, idmap *IDMap, rootless bool) (bool, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return false, err
+	}
+	chainIDs, err := config.ChainIDs()
+	if err != nil {
+		return false, err
+	}
+	chainID, err := snapshotKey(chainIDs[len(chainIDs)-1], idmap, rootless)
+	if err != nil {
+		return false, err
+	}
+	return pathDigest(target) == chainID.Name, nil
+}
+
+// extractSnapshot applies the layers of m with the Snapshotter sn, unless its
+// snapshot is already committed, and returns the path of the snapshot. The
+// owners of its files are shifted by idmap, if not nil, and it is stored by
+// chainIDs keyed by idmap and Rootless (see snapshotKey). The metadata of its
+// files that could not be applied, and the device nodes not created, are added
+// to result.
+func (l Layout) extractSnapshot(sn Snapshotter, m *layout.Manifest, config *layout.Config, idmap *IDMap, result *ExtractResult) (string, error) {
+	// each layer's _uncompressed_ checksum is cross-referenced against the
+	// config's rootfs.diff_ids, so they must line up.
+	diffIDs := config.ImageConfig.RootFS.DiffIDs
+	if len(diffIDs) != len(m.Manifest.Layers) {
+		return "", fmt.Errorf("manifest has %d layers, but config has %d diff_ids", len(m.Manifest.Layers), len(diffIDs))
+	}
+	// a snapshot without one of its layers is not the image, so it is not made
+	for _, desc := range m.Manifest.Layers {
+		if _, ok := Decompressors[layout.CanonicalMediaType(desc.MediaType)]; !ok {
+			util.Debugf("layer %q is of the unsupported %q", desc.Digest, desc.MediaType)
+			return "", layout.ErrUnsupportedMediaType
+		}
+	}
+	chainIDs, err := config.ChainIDs()
+	if err != nil {
+		return "", err
+	}
+	for i := range chainIDs {
+		if chainIDs[i], err = snapshotKey(chainIDs[i], idmap, Rootless); err != nil {
+			return "", err
+		}
+	}
+	chainID := chainIDs[len(chainIDs)-1]
+	destpath, err := sn.Path(chainID)
+	if err != nil {
+		return "", err
+	}
+
+	lock, err := l.lockChainID(chainID.HashName(), chainID.Sum())
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	if sn.Committed(destpath) {
+		util.Debugf("chainID %q already exists. Not applying.", chainID.Name)
+		return destpath, nil
+	}
+	// anything left from an extraction that did not finish is not trusted
+	if err := sn.Remove(destpath); err != nil {
+		return "", err
+	}
+
+	// the diffIDs are checked before preparing, so there is nothing to abort
+	layerKeys := make([]*layout.DigestRef, len(diffIDs))
+	for i := range diffIDs {
+		diffID := layout.DigestRef{Name: diffIDs[i]}
+		if err := diffID.Validate(); err != nil {
+			return "", fmt.Errorf("diff_id %q: %s", diffID.Name, err)
+		}
+		if layerKeys[i], err = snapshotKey(&diffID, idmap, Rootless); err != nil {
+			return "", err
+		}
+	}
+
+	active, start, err := sn.Prepare(chainIDs)
+	if err != nil {
+		return "", fmt.Errorf("error preparing %s: %s", destpath, err)
+	}
+	// ugh, here we'll have to access the objects in order from the manifest
+	for i, desc := range m.Manifest.Layers[start:] {
+		i += start
+		diffID := layout.DigestRef{Name: diffIDs[i]}
+		err = active.Apply(layerKeys[i], func(dir string, opts LayerOptions) error {
+			brdr, err := m.Layout.GetBlob(layout.DescriptorRef(m.Layout, desc))
+			if err != nil {
+				return err
+			}
+			defer brdr.Close()
+
+			util.Debugf("Applying %q to %q", desc.Digest, dir)
+			opts.DiffID = diffID.Name
+			opts.StrictMetadata = StrictMetadata
+			opts.Rootless = Rootless
+			opts.IDMap = idmap
+			applied, err := ApplyLayer(dir, desc.MediaType, brdr, opts)
+			if err == ErrDiffIDMismatch {
+				return fmt.Errorf("layer %q: %s %q", desc.Digest, err, diffID.Name)
+			} else if err != nil {
+				return err
+			}
+			result.Metadata = append(result.Metadata, applied.Metadata...)
+			result.Devices = append(result.Devices, applied.Devices...)
+
+			// the blob is verified as it is read, which is only complete at its end
+			if _, err := io.Copy(ioutil.Discard, brdr); err != nil {
+				return fmt.Errorf("layer %q: %s", desc.Digest, err)
+			}
+			return nil
+		})
+		if err != nil {
+			// a partially applied snapshot is never mistaken for a good one
+			active.Abort()
+			return "", err
+		}
+	}
+	if err := active.Commit(); err != nil {
+		active.Abort()
+		return "", err
+	}
+	return destpath, nil
+}
@@ -0,0 +1,54 @@
+package extract
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotters(t *testing.T) {
+	defer func(s Storage) { DefaultStorage = s }(DefaultStorage)
+
+	for _, storage := range []Storage{StorageNaive, StorageReflink} {
+		dir, err := ioutil.TempDir("", "test-snapshot.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		layouts := filepath.Join(dir, "layouts")
+		extracts := filepath.Join(dir, "extracts")
+
+		DefaultStorage = storage
+		m := newImage(t, layouts, "example.com/app",
+			makeTar(t, tarEntry{hdr: tar.Header{Name: "etc/motd"}, body: "slartibartfast\n"}))
+		m.Ref = "latest"
+		el, err := Extract(extracts, m)
+		if err != nil {
+			t.Fatalf("%s: %s", storage, err)
+		}
+
+		// the ref is mounted by the snapshotter that stored it, even once the
+		// storage is changed
+		DefaultStorage = StorageOverlay
+		ref := Ref{Name: "latest", Layout: el}
+		mnt, err := ref.Mount()
+		if err != nil {
+			t.Fatalf("%s: %s", storage, err)
+		}
+		if mnt.Type != "" || mnt.Where != ref.RootFS() {
+			t.Errorf("%s: expected the rootfs to be used as it is; got %#v", storage, mnt)
+		}
+		if _, err := os.Stat(filepath.Join(mnt.Where, "etc/motd")); err != nil {
+			t.Errorf("%s: %s", storage, err)
+		}
+	}
+
+	if _, err := ParseStorage("reflink"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseStorage("zfs"); err == nil {
+		t.Error("expected an unknown storage to fail")
+	}
+}
@@ -10,4 +10,25 @@ var (
 	nameDirs       = "dirs"
 	nameChainID    = "chainID"
 	nameChainIDDir = filepath.Join(nameDirs, nameChainID)
+	nameTmp        = "tmp"
+	nameLayers     = "layers"
+	nameOverlays   = "overlays"
+	nameVerified   = "verified"
+
+	// the per ref directories for StorageOverlay
+	nameOverlay = "overlay"
+	nameUpper   = "upper"
+	nameWork    = "work"
+	nameMerged  = "merged"
+
+	nameCurrent     = "current"
+	nameGenerations = "generations"
+	nameInfo        = "info"
+
+	nameLocks     = "locks"
+	nameStoreLock = "store"
+	lockSuffix    = ".lock"
+
+	// completeSuffix is the suffix of the marker for a fully extracted chainID
+	completeSuffix = ".complete"
 )
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 
 	"github.com/vbatts/oci-systemd-generator/layout"
+	"github.com/vbatts/oci-systemd-generator/util"
 )
 
 // WalkForExtracts walks a rootpath looking for all directories that match an
@@ -17,6 +18,7 @@ func WalkForExtracts(rootpath string) (extracts []*Layout, err error) {
 		return nil, err
 	}
 	extracts = []*Layout{}
+	seen := map[string]bool{}
 	err = filepath.Walk(namespath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -25,38 +27,31 @@ func WalkForExtracts(rootpath string) (extracts []*Layout, err error) {
 			return nil
 		}
 
-		var (
-			altDir   string
-			basename = filepath.Base(path)
-			dirname  = filepath.Dir(path)
-		)
-		switch basename {
-		case nameRef:
-			altDir = filepath.Join(dirname, nameRootfs)
-		case nameRootfs:
-			altDir = filepath.Join(dirname, nameRef)
-		default:
-			return nil
-		}
-
-		if altInfo, err := os.Lstat(altDir); err != nil || !altInfo.IsDir() {
-			// either this is an error OR it is nil because the directory is not a directory,
-			// so just skip it
-			return nil
+		// a ref's directory has the config and rootfs symlinks
+		for _, name := range []string{nameRef, nameRootfs} {
+			if _, err := os.Lstat(filepath.Join(path, name)); err != nil {
+				return nil
+			}
 		}
 
-		l, err := filepath.Rel(namespath, dirname)
+		l, err := filepath.Rel(namespath, filepath.Dir(path))
 		if err != nil {
 			return err
 		}
-		extracts = append(extracts, &Layout{Root: rootpath, Name: l})
-		return nil
+		if !seen[l] {
+			seen[l] = true
+			extracts = append(extracts, &Layout{Root: rootpath, Name: l, HashName: DefaultHashName})
+		}
+		return filepath.SkipDir
 	})
 	return extracts, err
 }
 
 // DetermineNotExtracted returns only the list of manifests that are not
-// present in the provided list of extracted layouts.
+// present in the provided list of extracted layouts. A ref that is extracted,
+// but with a different config than its manifest now has (i.e. the ref moved to
+// a new image), is returned too. For a ref with generations, the config is that
+// of its latest generation rather than its current one.
 func DetermineNotExtracted(extracts []*Layout, manifests []*layout.Manifest) ([]*layout.Manifest, error) {
 	ne := []*layout.Manifest{}
 	for _, manifest := range manifests {
@@ -70,9 +65,44 @@ func DetermineNotExtracted(extracts []*Layout, manifests []*layout.Manifest) ([]
 				return nil, err
 			}
 			for _, eRef := range eRefs {
-				if manifest.Layout.Name == el.Name && manifest.Ref == eRef.Name {
-					found = true
+				if manifest.Ref != eRef.Name {
+					continue
+				}
+				// the rootfs must also be there, in case its chainID was
+				// removed for being incomplete.
+				if _, err := os.Stat(eRef.RootFS()); err != nil {
+					continue
+				}
+				// compared with the latest generation, so that a ref rolled back
+				// to an older generation is left as it is.
+				configPath, rootfsPath := eRef.Layout.refPath(eRef.Name), eRef.RootFS()
+				if g, err := eRef.LatestGeneration(); err == nil {
+					configPath, rootfsPath = g.ConfigPath(), g.RootFS()
+				} else if err != ErrNoGeneration {
+					return nil, err
+				}
+				same, err := hasConfig(configPath, manifest.Manifest.Config.Digest)
+				if err != nil {
+					return nil, err
+				}
+				if !same {
+					util.Debugf("%s/%s has moved to config %q", el.Name, eRef.Name, manifest.Manifest.Config.Digest)
+					continue
+				}
+				// and extracted with its current IDMap, rootless or not
+				config, err := manifest.Config()
+				if err != nil {
+					return nil, err
+				}
+				same, err = hasSnapshotKey(rootfsPath, config, IDMaps[el.Name], Rootless)
+				if err != nil {
+					return nil, err
+				}
+				if !same {
+					util.Debugf("%s/%s was extracted with a different idmap, or rootless", el.Name, eRef.Name)
+					continue
 				}
+				found = true
 			}
 		}
 		if !found {
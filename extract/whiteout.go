@@ -0,0 +1,113 @@
+package extract
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whiteouts only apply to the lower layers, wherever they are in the layer's
+// stream (see the "Whiteouts" of the OCI image layer spec). So they are applied
+// once all of the layer's other entries are, and remove everything at their
+// path except what the layer itself wrote.
+
+// layerPaths are the entries written by the layer being applied
+type layerPaths struct {
+	written map[string]bool // entries of the layer
+	parents map[string]bool // directories with entries of the layer under them
+}
+
+func newLayerPaths() layerPaths {
+	return layerPaths{written: map[string]bool{}, parents: map[string]bool{}}
+}
+
+// add the entry name, which is clean and relative to the root
+func (p layerPaths) add(name string) {
+	p.written[name] = true
+	for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		p.parents[dir] = true
+	}
+	p.parents["."] = true
+}
+
+// has is whether the layer wrote name, or something under it
+func (p layerPaths) has(name string) bool {
+	return p.written[name] || p.parents[name]
+}
+
+// removeWhiteout removes what the whiteout entry name whites out of the lower
+// layers. An opaque whiteout (`.wh..wh..opq`) removes the lower layers' entries
+// of its directory, but not the directory itself.
+func (r *rootDir) removeWhiteout(name string, paths layerPaths) error {
+	if filepath.Base(name) == whiteoutPrefix+whiteoutPrefix+".opq" {
+		dirfd, _, err := r.openParent(name, false)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer unix.Close(dirfd)
+		return paths.removeLowerChildren(dirfd, ".", filepath.Dir(name))
+	}
+
+	pathToDelete := pathFromWhiteout(name)
+	if pathToDelete == "" {
+		return nil
+	}
+	dirfd, base, err := r.openParent(pathToDelete, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer unix.Close(dirfd)
+	return paths.removeLower(dirfd, base, pathToDelete)
+}
+
+// removeLower removes the entry name of dirfd (rel in the layer), or if the
+// layer wrote under it, what of the lower layers is under it.
+func (p layerPaths) removeLower(dirfd int, name, rel string) error {
+	if !p.has(rel) {
+		// removed through the directory's fd, so it stays in the root
+		return os.RemoveAll(fdPath(dirfd, name))
+	}
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return &os.PathError{Op: "stat", Path: rel, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		// the layer's own
+		return nil
+	}
+	return p.removeLowerChildren(dirfd, name, rel)
+}
+
+// removeLowerChildren is removeLower for each entry of the directory name of
+// dirfd
+func (p layerPaths) removeLowerChildren(dirfd int, name, rel string) error {
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if err == unix.ENOENT || err == unix.ENOTDIR {
+			return nil
+		}
+		return &os.PathError{Op: "open", Path: rel, Err: err}
+	}
+	dir := os.NewFile(uintptr(fd), rel)
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, child := range names {
+		if err := p.removeLower(fd, child, filepath.Join(rel, child)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/vbatts/oci-systemd-generator/layout"
+)
+
+func TestWhiteouts(t *testing.T) {
+	base := []tarEntry{
+		{hdr: tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "etc/motd"}, body: "lower\n"},
+		{hdr: tar.Header{Name: "etc/issue"}, body: "lower\n"},
+		{hdr: tar.Header{Name: "var/cache/apt/pkgcache.bin"}, body: "lower\n"},
+		{hdr: tar.Header{Name: "var/cache/man/index.db"}, body: "lower\n"},
+		{hdr: tar.Header{Name: "var/log/dpkg.log"}, body: "lower\n"},
+	}
+	cases := []struct {
+		name     string
+		layers   [][]tarEntry
+		contents map[string]string // files expected, with their content
+		absent   []string
+		invalid  bool // the last layer fails with ErrInvalidWhiteout
+	}{
+		{
+			name:     "file",
+			layers:   [][]tarEntry{base, {{hdr: tar.Header{Name: "etc/.wh.motd"}}}},
+			contents: map[string]string{"etc/issue": "lower\n"},
+			absent:   []string{"etc/motd"},
+		},
+		{
+			name:     "directory",
+			layers:   [][]tarEntry{base, {{hdr: tar.Header{Name: "var/.wh.cache"}}}},
+			contents: map[string]string{"var/log/dpkg.log": "lower\n"},
+			absent:   []string{"var/cache"},
+		},
+		{
+			name:     "missing",
+			layers:   [][]tarEntry{base, {{hdr: tar.Header{Name: "opt/.wh.nothing"}}, {hdr: tar.Header{Name: "etc/.wh.nothing"}}}},
+			contents: map[string]string{"etc/motd": "lower\n"},
+		},
+		{
+			name: "only the lower layers",
+			layers: [][]tarEntry{{
+				{hdr: tar.Header{Name: "etc/motd"}, body: "same\n"},
+				{hdr: tar.Header{Name: "etc/.wh.motd"}},
+			}},
+			contents: map[string]string{"etc/motd": "same\n"},
+		},
+		{
+			name: "file re-created before its whiteout",
+			layers: [][]tarEntry{base, {
+				{hdr: tar.Header{Name: "etc/motd"}, body: "upper\n"},
+				{hdr: tar.Header{Name: "etc/.wh.motd"}},
+			}},
+			contents: map[string]string{"etc/motd": "upper\n", "etc/issue": "lower\n"},
+		},
+		{
+			name: "file re-created after its whiteout",
+			layers: [][]tarEntry{base, {
+				{hdr: tar.Header{Name: "etc/.wh.motd"}},
+				{hdr: tar.Header{Name: "etc/motd"}, body: "upper\n"},
+			}},
+			contents: map[string]string{"etc/motd": "upper\n"},
+		},
+		{
+			name: "directory re-created",
+			layers: [][]tarEntry{base, {
+				{hdr: tar.Header{Name: "var/cache/apt/srcpkgcache.bin"}, body: "upper\n"},
+				{hdr: tar.Header{Name: "var/.wh.cache"}},
+			}},
+			contents: map[string]string{"var/cache/apt/srcpkgcache.bin": "upper\n", "var/log/dpkg.log": "lower\n"},
+			absent:   []string{"var/cache/apt/pkgcache.bin", "var/cache/man"},
+		},
+		{
+			name: "deleted then re-created in a later layer",
+			layers: [][]tarEntry{base,
+				{{hdr: tar.Header{Name: ".wh.etc"}}},
+				{{hdr: tar.Header{Name: "etc/motd"}, body: "again\n"}},
+			},
+			contents: map[string]string{"etc/motd": "again\n"},
+			absent:   []string{"etc/issue"},
+		},
+		{
+			name: "opaque directory, with entries before it",
+			layers: [][]tarEntry{base, {
+				{hdr: tar.Header{Name: "var/cache/fonts/cache"}, body: "upper\n"},
+				{hdr: tar.Header{Name: "var/cache/apt/srcpkgcache.bin"}, body: "upper\n"},
+				{hdr: tar.Header{Name: "var/cache/.wh..wh..opq"}},
+			}},
+			contents: map[string]string{
+				"var/cache/fonts/cache":         "upper\n",
+				"var/cache/apt/srcpkgcache.bin": "upper\n",
+				"var/log/dpkg.log":              "lower\n",
+			},
+			absent: []string{"var/cache/apt/pkgcache.bin", "var/cache/man"},
+		},
+		{
+			name: "opaque directory, with entries after it",
+			layers: [][]tarEntry{base, {
+				{hdr: tar.Header{Name: "var/cache/.wh..wh..opq"}},
+				{hdr: tar.Header{Name: "var/cache/fonts/cache"}, body: "upper\n"},
+			}},
+			contents: map[string]string{"var/cache/fonts/cache": "upper\n"},
+			absent:   []string{"var/cache/apt", "var/cache/man"},
+		},
+		{
+			name: "opaque root",
+			layers: [][]tarEntry{base, {
+				{hdr: tar.Header{Name: "bin/true"}, body: "upper\n"},
+				{hdr: tar.Header{Name: ".wh..wh..opq"}},
+			}},
+			contents: map[string]string{"bin/true": "upper\n"},
+			absent:   []string{"etc", "var"},
+		},
+		{
+			name:     "invalid, of the root",
+			layers:   [][]tarEntry{base, {{hdr: tar.Header{Name: ".wh.."}}}},
+			contents: map[string]string{"etc/motd": "lower\n", "var/log/dpkg.log": "lower\n"},
+			invalid:  true,
+		},
+		{
+			name: "invalid, of the parent",
+			layers: [][]tarEntry{base, {
+				{hdr: tar.Header{Name: "app/x"}, body: "upper\n"},
+				{hdr: tar.Header{Name: "app/.wh..."}},
+			}},
+			contents: map[string]string{"etc/motd": "lower\n", "var/log/dpkg.log": "lower\n"},
+			invalid:  true,
+		},
+		{
+			name:     "invalid, without a name",
+			layers:   [][]tarEntry{base, {{hdr: tar.Header{Name: "etc/.wh."}}}},
+			contents: map[string]string{"etc/motd": "lower\n", "etc/issue": "lower\n"},
+			invalid:  true,
+		},
+		{
+			name:     "invalid, of the directory",
+			layers:   [][]tarEntry{base, {{hdr: tar.Header{Name: "var/log/.wh.."}}}},
+			contents: map[string]string{"var/log/dpkg.log": "lower\n"},
+			invalid:  true,
+		},
+	}
+
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "test-whiteout.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for i, entries := range c.layers {
+			_, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(makeTar(t, entries...)), LayerOptions{})
+			if c.invalid && i == len(c.layers)-1 {
+				if perr, ok := err.(*os.PathError); !ok || perr.Err != ErrInvalidWhiteout {
+					t.Errorf("%s: expected ErrInvalidWhiteout; got %v", c.name, err)
+				}
+			} else if err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+		}
+		for name, content := range c.contents {
+			buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil || string(buf) != content {
+				t.Errorf("%s: expected %s to be %q; got %q (%v)", c.name, name, content, buf, err)
+			}
+		}
+		for _, name := range c.absent {
+			if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("%s: expected %s to be removed; got %v", c.name, name, err)
+			}
+		}
+	}
+}
+
+func TestOverlayWhiteoutRecreated(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("overlay whiteouts need root")
+	}
+	dir, err := ioutil.TempDir("", "test-whiteout.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a directory that replaces the lower one hides its entries, and a file
+	// just replaces it
+	layer := makeTar(t,
+		tarEntry{hdr: tar.Header{Name: "etc/new"}, body: "upper\n"},
+		tarEntry{hdr: tar.Header{Name: ".wh.etc"}},
+		tarEntry{hdr: tar.Header{Name: ".wh.motd"}},
+		tarEntry{hdr: tar.Header{Name: "motd"}, body: "upper\n"},
+		tarEntry{hdr: tar.Header{Name: ".wh.issue"}},
+	)
+	if _, err := ApplyLayer(dir, layout.MediaTypeImageLayerTar, bytes.NewReader(layer), LayerOptions{Overlay: true}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if n, err := syscall.Getxattr(filepath.Join(dir, "etc"), overlayOpaqueXattr, buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("expected etc to be opaque; got %q (%v)", buf, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "motd")); err != nil || string(content) != "upper\n" {
+		t.Errorf("expected motd to be kept; got %q (%v)", content, err)
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "issue")); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("expected issue to be a whiteout; got %v", err)
+	}
+}
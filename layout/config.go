@@ -1,10 +1,10 @@
 package layout
 
 import (
-	"crypto/sha256"
 	"fmt"
 
 	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/oci-systemd-generator/util"
 )
 
 // Config carries the layout and ref name, plus the full structure for the OCI
@@ -32,6 +32,7 @@ func (c Config) diffIDsDigests() []DigestRef {
 }
 
 // ChainID is the calculated identification of the culmination of an OCI image config's diff_ids.
+// The chainID is summed with the hash of the diff_ids' digests.
 // See https://github.com/opencontainers/image-spec/blob/master/config.md#layer-chainid
 func (c Config) ChainID() (*DigestRef, error) {
 	if c.ImageConfig == nil {
@@ -41,10 +42,41 @@ func (c Config) ChainID() (*DigestRef, error) {
 	if digestRefs == nil {
 		return nil, fmt.Errorf("failed to get the diff_ids")
 	}
+	for _, digestRef := range digestRefs {
+		if err := digestRef.Validate(); err != nil {
+			return nil, fmt.Errorf("diff_id %q: %s", digestRef.Name, err)
+		}
+	}
 
 	return chainID(nil, digestRefs...), nil
 }
 
+// ChainIDs are the chainIDs of each layer of the image, i.e. ChainIDs()[i] is
+// the chainID of the diff_ids up to and including the i'th. The last is the
+// same as ChainID().
+func (c Config) ChainIDs() ([]*DigestRef, error) {
+	if c.ImageConfig == nil {
+		return nil, fmt.Errorf("no ImageConfig present")
+	}
+	digestRefs := c.diffIDsDigests()
+	if digestRefs == nil {
+		return nil, fmt.Errorf("failed to get the diff_ids")
+	}
+	chainIDs := make([]*DigestRef, len(digestRefs))
+	for i, digestRef := range digestRefs {
+		if err := digestRef.Validate(); err != nil {
+			return nil, fmt.Errorf("diff_id %q: %s", digestRef.Name, err)
+		}
+		if i == 0 {
+			d := digestRef
+			chainIDs[i] = &d
+			continue
+		}
+		chainIDs[i] = chainID(chainIDs[i-1], digestRef)
+	}
+	return chainIDs, nil
+}
+
 func chainID(prev *DigestRef, diffIDs ...DigestRef) *DigestRef {
 	if diffIDs == nil || len(diffIDs) == 0 {
 		return prev
@@ -52,6 +84,7 @@ func chainID(prev *DigestRef, diffIDs ...DigestRef) *DigestRef {
 	if prev == nil {
 		return chainID(&diffIDs[0], diffIDs[1:]...)
 	}
-	sum := sha256.Sum256([]byte(prev.Name + " " + diffIDs[0].Name))
-	return chainID(&DigestRef{Name: fmt.Sprintf("sha256:%x", sum), Layout: prev.Layout}, diffIDs[1:]...)
+	h := util.HashMap[prev.HashName()].New()
+	h.Write([]byte(prev.Name + " " + diffIDs[0].Name))
+	return chainID(&DigestRef{Name: fmt.Sprintf("%s%s%x", prev.HashName(), digestSeparator, h.Sum(nil)), Layout: prev.Layout}, diffIDs[1:]...)
 }
@@ -41,4 +41,46 @@ func TestChainID(t *testing.T) {
 	if chainDigest.Name != expect {
 		t.Fatalf("expected %q; got %q", expect, chainDigest.Name)
 	}
+
+	chainIDs, err := c.ChainIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expect := range []string{
+		"sha256:8b2564fc821995bf961877c06e676591297178a4438293ec1c2e20f66855d3a8",
+		"sha256:888ad5c8dbef3450399e600298ade969489529a44204ac761a76b7ff494767e6",
+		expect,
+	} {
+		if len(chainIDs) <= i || chainIDs[i].Name != expect {
+			t.Errorf("%d: expected %q; got %v", i, expect, chainIDs)
+		}
+	}
+}
+
+func TestChainIDSHA512(t *testing.T) {
+	expect := "sha512:8d2c2481071e15f879506dc428fd6753ae75228388d1a0dbfad09d4f5d184f41df3226f27b5eba599bf42f58ff8ab8175d670deb07f5865cfa5c05712979cbc9"
+	c := Config{
+		ImageConfig: &v1.Image{
+			RootFS: v1.RootFS{
+				Type: "layers",
+				DiffIDs: []string{
+					"sha512:1f40fc92da241694750979ee6cf582f2d5d7d28e18335de05abc54d0560e0f5302860c652bf08d560252aa5e74210546f369fbbbce8c12cfc7957b2652fe9a75",
+					"sha512:5267768822ee624d48fce15ec5ca79cbd602cb7f4c2157a516556991f22ef8c7b5ef7b18d1ff41c59370efb0858651d44a936c11b7b144c48fe04df3c6a3e8da",
+					"sha512:acc28db2beb7b42baa1cb0243d401ccb4e3fce44d7b02879a52799aadff541522d8822598b2fa664f9d5156c00c924805d75c3868bd56c2acb81d37e98e35adc",
+				},
+			},
+		},
+	}
+	chainDigest, err := c.ChainID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chainDigest.Name != expect {
+		t.Fatalf("expected %q; got %q", expect, chainDigest.Name)
+	}
+
+	c.ImageConfig.RootFS.DiffIDs = append(c.ImageConfig.RootFS.DiffIDs, "sha512:../../../etc")
+	if _, err := c.ChainID(); err == nil {
+		t.Errorf("expected an error for a malformed diff_id")
+	}
 }
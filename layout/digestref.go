@@ -1,9 +1,13 @@
 package layout
 
 import (
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/vbatts/oci-systemd-generator/util"
 )
 
@@ -12,6 +16,17 @@ import (
 type DigestRef struct {
 	Name   string
 	Layout *Layout
+	Size   int64 // expected size of the blob, if HasSize
+
+	// HasSize is whether Size is known (as from a descriptor), and so checked.
+	// A Size of zero is then a blob that is empty.
+	HasSize bool
+}
+
+// DescriptorRef is the DigestRef for the blob of descriptor d in layout l,
+// including its expected size (which is zero if d has none).
+func DescriptorRef(l *Layout, d v1.Descriptor) DigestRef {
+	return DigestRef{Name: d.Digest, Layout: l, Size: d.Size, HasSize: true}
 }
 
 // HashName provides just the hash name portion of the digest string (e.g. "sha256:ed2dca..." -> "sha256")
@@ -32,23 +47,54 @@ func (d DigestRef) Sum() string {
 	return chunks[1]
 }
 
+// Validate checks that the digest is well formed, of a known hash, and of the
+// right length for that hash (see util.ValidateDigest).
+func (d DigestRef) Validate() error {
+	return util.ValidateDigest(d.Name)
+}
+
 // Calculate the checksum of the backing blob for this digest, with the prescribed hash.
 func (d DigestRef) Calculate() (string, error) {
-	fh, err := d.Layout.GetBlob(d)
+	if err := d.Validate(); err != nil {
+		return "", err
+	}
+	fh, err := os.Open(d.Layout.blobPath(d))
 	if err != nil {
 		return "", err
 	}
+	defer fh.Close()
 	return util.SumContent(d.HashName(), fh)
 }
 
 // IsValid returns whether the backing blob checksum is the same as the referenced digest.
+// Blobs already verified by the layout's Cache are not read again.
 func (d DigestRef) IsValid() (bool, error) {
-	sum, err := d.Calculate()
+	fh, err := d.Layout.GetBlob(d)
 	if err != nil {
 		return false, err
 	}
+	defer fh.Close()
+	if _, ok := fh.(*verifyingReader); !ok {
+		// the cache has already seen this blob
+		return true, nil
+	}
+	if _, err := io.Copy(ioutil.Discard, fh); err != nil {
+		if err == ErrDigestMismatch {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
 
-	return d.Name == d.HashName()+digestSeparator+sum, nil
+// exists is whether the backing blob is there, and of the referenced size (if
+// set), without reading it
+func (d DigestRef) exists() (bool, error) {
+	fh, err := d.Layout.GetBlob(d)
+	if err != nil {
+		return false, err
+	}
+	return true, fh.Close()
 }
 
 // "sha256:ed2dca7ba0aa32384f2f5560513dbb0325c8e213b75eb662055e8bd1db7ac974" -> "./sha256/ed2dca7ba0aa32384f2f5560513dbb0325c8e213b75eb662055e8bd1db7ac974"
@@ -69,5 +115,9 @@ func pathToDigest(path string) *DigestRef {
 	if len(chunks) != 2 {
 		return nil
 	}
-	return &DigestRef{Name: chunks[0] + digestSeparator + chunks[1]}
+	digest := &DigestRef{Name: chunks[0] + digestSeparator + chunks[1]}
+	if digest.Validate() != nil {
+		return nil
+	}
+	return digest
 }
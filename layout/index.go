@@ -0,0 +1,158 @@
+package layout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/oci-systemd-generator/util"
+)
+
+const (
+	nameIndex = "index.json"
+
+	// MediaTypeImageIndex is the media type of an image-spec 1.0 image index,
+	// formerly known as the manifest list.
+	MediaTypeImageIndex = "application/vnd.oci.image.index.v1+json"
+
+	// AnnotationRefName is the annotation on an index.json descriptor that
+	// names the reference (e.g. "stable", "v1.0.0").
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// ErrInvalidRefName is returned for a ref name that does not match the ref
+// grammar of the image-spec (see ValidateRefName)
+var ErrInvalidRefName = errors.New("invalid ref name")
+
+// refNameRegexp is the image-spec grammar of ref names:
+//
+//	ref       ::= component ("/" component)*
+//	component ::= alphanum (separator alphanum)*
+//	alphanum  ::= [A-Za-z0-9]+
+//	separator ::= [-._:@+] | "--"
+var refNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]+((--|[-._:@+])[A-Za-z0-9]+)*(/[A-Za-z0-9]+((--|[-._:@+])[A-Za-z0-9]+)*)*$`)
+
+// ValidateRefName checks that name is a ref name per the image-spec, so that
+// it is not empty, and has no leading "/" nor ".." to lead out of a directory
+// it is stored under.
+func ValidateRefName(name string) error {
+	if !refNameRegexp.MatchString(name) {
+		return fmt.Errorf("%q: %s", name, ErrInvalidRefName)
+	}
+	return nil
+}
+
+// IndexDescriptor is a descriptor as found in an OCI image index. Beyond the
+// plain v1.Descriptor, it carries the platform and annotations of the entry.
+type IndexDescriptor struct {
+	v1.Descriptor
+	Platform    *v1.Platform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// RefName is the reference name annotated on this descriptor, if any.
+func (d IndexDescriptor) RefName() string {
+	if d.Annotations == nil {
+		return ""
+	}
+	return d.Annotations[AnnotationRefName]
+}
+
+// Index is the OCI image index, as found in the `index.json` of an image-spec
+// 1.0 layout.
+type Index struct {
+	specs.Versioned
+	Manifests   []IndexDescriptor `json:"manifests"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// HasIndex is whether this layout has an `index.json` (as opposed to only the
+// legacy `refs/` directory)
+func (l Layout) HasIndex() bool {
+	info, err := os.Stat(filepath.Join(l.Root, l.Name, nameIndex))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Index reads the `index.json` of this layout
+func (l Layout) Index() (*Index, error) {
+	buf, err := readFileLimit(filepath.Join(l.Root, l.Name, nameIndex), MaxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	var index Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// indexFromBlob reads an image index (or manifest list) blob
+func (l Layout) indexFromBlob(digest DigestRef) (*Index, error) {
+	buf, err := l.readBlob(digest, MaxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	var index Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// indexRefs gives the ref names annotated in this layout's `index.json`.
+// Entries without a ref name can not be addressed, so they are skipped, as are
+// those with a name that is not valid (see ValidateRefName).
+func (l Layout) indexRefs() ([]string, error) {
+	index, err := l.Index()
+	if err != nil {
+		return nil, err
+	}
+	refs := []string{}
+	for _, desc := range index.Manifests {
+		name := desc.RefName()
+		if name == "" {
+			continue
+		}
+		if err := ValidateRefName(name); err != nil {
+			util.Warnf("%s: skipping ref: %s", l.Name, err)
+			continue
+		}
+		refs = append(refs, name)
+	}
+	return refs, nil
+}
+
+// indexRef finds the descriptor for ref name in this layout's `index.json`.
+// Some tools write an entry of the same ref name per platform, in which case
+// the one that best matches platform p is picked, as from an image index.
+// Returns os.ErrNotExist if there is no such ref.
+func (l Layout) indexRef(name string, p v1.Platform) (*v1.Descriptor, error) {
+	index, err := l.Index()
+	if err != nil {
+		return nil, err
+	}
+	matches := []IndexDescriptor{}
+	for _, desc := range index.Manifests {
+		if desc.RefName() == name {
+			matches = append(matches, desc)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, os.ErrNotExist
+	case 1:
+		d := matches[0].Descriptor
+		return &d, nil
+	}
+	desc, err := resolvePlatform(&l, matches, p, 0)
+	if err != nil {
+		return nil, err
+	}
+	util.Debugf("ref %q of %q resolved to %q for %s", name, l.Name, desc.Digest, PlatformString(p))
+	return desc, nil
+}
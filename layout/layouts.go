@@ -2,6 +2,8 @@ package layout
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -25,10 +27,24 @@ type Layouts map[string]*Layout
 // Layout is an OCI image layout that includes descriptor refs and the content
 // addressible objects pointed to by the descriptors.
 type Layout struct {
-	Root string
-	Name string
+	Root  string
+	Name  string
+	Cache *BlobCache // blobs already verified; may be nil
+
+	// Version is the imageLayoutVersion of the oci-layout file, as found by
+	// WalkForLayouts. VersionErr is set when the version could not be read, or
+	// is not one of KnownLayoutVersions, and such a layout must not be used.
+	Version    string
+	VersionErr error
 }
 
+// KnownLayoutVersions are the oci-layout imageLayoutVersion values supported
+var KnownLayoutVersions = []string{"1.0.0"}
+
+// ErrUnsupportedLayoutVersion is for an oci-layout version that is not in
+// KnownLayoutVersions
+var ErrUnsupportedLayoutVersion = errors.New("unsupported oci-layout version")
+
 // OCIVersion reads the OCI image layout version for this layout
 func (l Layout) OCIVersion() (string, error) {
 	buf, err := ioutil.ReadFile(filepath.Join(l.Root, l.Name, nameLayout))
@@ -44,14 +60,83 @@ func (l Layout) OCIVersion() (string, error) {
 	return ociImageLayout.Version, nil
 }
 
-// Refs gives the path to all regular files or symlinks in this layout's "refs" directory
+// CheckVersion reads the OCI image layout version for this layout, and checks
+// that it is one of KnownLayoutVersions
+func (l Layout) CheckVersion() (string, error) {
+	vers, err := l.OCIVersion()
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %s", nameLayout, err)
+	}
+	for _, known := range KnownLayoutVersions {
+		if vers == known {
+			return vers, nil
+		}
+	}
+	return vers, ErrUnsupportedLayoutVersion
+}
+
+// Refs gives the names of the references in this layout. These are the ref
+// name annotations of the `index.json` entries, and the path to all regular
+// files or symlinks in the legacy "refs" directory. Names that are not valid
+// (see ValidateRefName) are skipped with a warning.
 func (l Layout) Refs() ([]string, error) {
-	return util.FindFilesOrSymlink(filepath.Join(l.Root, l.Name, nameRefs))
+	refs := []string{}
+	seen := map[string]bool{}
+	if l.HasIndex() {
+		names, err := l.indexRefs()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				refs = append(refs, name)
+			}
+		}
+	}
+	if l.hasRefsDir() {
+		names, err := util.FindFilesOrSymlink(filepath.Join(l.Root, l.Name, nameRefs))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if err := ValidateRefName(name); err != nil {
+				util.Warnf("%s: skipping ref: %s", l.Name, err)
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				refs = append(refs, name)
+			}
+		}
+	}
+	return refs, nil
 }
 
-// GetRef loads the descriptor reference for this OCI image
+// GetRef loads the descriptor reference for this OCI image. The `index.json`
+// is consulted first, then the legacy "refs" directory. Where `index.json` has
+// an entry of name per platform, the one for the running host is used (see
+// HostPlatform).
 func (l Layout) GetRef(name string) (*v1.Descriptor, error) {
-	buf, err := ioutil.ReadFile(filepath.Join(l.Root, l.Name, nameRefs, name))
+	return l.GetRefForPlatform(name, HostPlatform())
+}
+
+// GetRefForPlatform is like GetRef, but of the `index.json` entries of name
+// per platform, the one that best matches platform p is used.
+func (l Layout) GetRefForPlatform(name string, p v1.Platform) (*v1.Descriptor, error) {
+	if err := ValidateRefName(name); err != nil {
+		return nil, err
+	}
+	if l.HasIndex() {
+		desc, err := l.indexRef(name, p)
+		if err == nil {
+			return desc, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	buf, err := readFileLimit(filepath.Join(l.Root, l.Name, nameRefs, name), MaxManifestSize)
 	if err != nil {
 		return nil, err
 	}
@@ -62,16 +147,67 @@ func (l Layout) GetRef(name string) (*v1.Descriptor, error) {
 	return &desc, nil
 }
 
+func (l Layout) hasRefsDir() bool {
+	info, err := os.Stat(filepath.Join(l.Root, l.Name, nameRefs))
+	return err == nil && info.IsDir()
+}
+
 // GetBlob returns the stream for a blob addressed by it's digest (`sha256:abcde123456...`)
+// The content is verified as it is read, and rather than io.EOF, reading a
+// blob that does not match the digest ends with ErrDigestMismatch. If the
+// digest HasSize, a blob of any other size is ErrSizeMismatch. Blobs
+// already verified by the layout's Cache are not hashed again.
 func (l Layout) GetBlob(digest DigestRef) (io.ReadCloser, error) {
-	path := filepath.Join(l.Root, l.Name, nameBlobs, digestToPath(digest))
-	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
+	// a malformed digest could otherwise point anywhere on the filesystem
+	if err := digest.Validate(); err != nil {
+		return nil, err
+	}
+	path := l.blobPath(digest)
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
 		return nil, err
 	}
-	return os.Open(path)
+	if digest.HasSize && info.Size() != digest.Size {
+		fh.Close()
+		util.Debugf("blob %q is %d bytes, but expected %d", digest.Name, info.Size(), digest.Size)
+		return nil, ErrSizeMismatch
+	}
+	if l.Cache.Verified(digest, path, info) {
+		return fh, nil
+	}
+	hash, ok := util.HashMap[digest.HashName()]
+	if !ok {
+		fh.Close()
+		return nil, util.ErrNoHash
+	}
+	return &verifyingReader{fh: fh, h: hash.New(), digest: digest, cache: l.Cache, info: info}, nil
 }
 
-// Blobs gives the path to all regular files or symlinks in this layout's "blobs" directory
+// readBlob reads the whole of a (small) blob, like a manifest or config, so
+// that it is verified. Blobs larger than max are ErrBlobTooLarge.
+func (l Layout) readBlob(digest DigestRef, max int64) ([]byte, error) {
+	if digest.HasSize && digest.Size > max {
+		return nil, ErrBlobTooLarge
+	}
+	fh, err := l.GetBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return ioutil.ReadAll(limitBlob(fh, max))
+}
+
+func (l Layout) blobPath(digest DigestRef) string {
+	return filepath.Join(l.Root, l.Name, nameBlobs, digestToPath(digest))
+}
+
+// Blobs gives the path to all regular files or symlinks in this layout's
+// "blobs" directory. Paths that are not a valid digest are skipped.
 func (l *Layout) Blobs() ([]DigestRef, error) {
 	paths, err := util.FindFilesOrSymlink(filepath.Join(l.Root, l.Name, nameBlobs))
 	if err != nil {
@@ -90,34 +226,31 @@ func (l *Layout) Blobs() ([]DigestRef, error) {
 }
 
 // WalkForLayouts looks through rootpath for OCI image-layout directories.
-// Namely a directory that has "refs" and "blobs" directory, and an oci-layout
-// file.
+// Namely a directory that has a "blobs" directory, an oci-layout file, and
+// either an `index.json` or a legacy "refs" directory.
+// Layouts with an unsupported oci-layout version are included, but with their
+// VersionErr set.
 func WalkForLayouts(rootpath string) (layouts Layouts, err error) {
 	layouts = Layouts{}
 	err = filepath.Walk(rootpath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			return nil
-		}
-		var (
-			altDir   string
-			basename = filepath.Base(path)
-			dirname  = filepath.Dir(path)
-		)
-		switch basename {
-		case nameRefs:
-			altDir = filepath.Join(dirname, nameBlobs)
-		case nameBlobs:
-			altDir = filepath.Join(dirname, nameRefs)
-		default:
+		if !info.IsDir() || filepath.Base(path) != nameBlobs {
 			return nil
 		}
+		dirname := filepath.Dir(path)
 
-		if altInfo, err := os.Lstat(altDir); err != nil || !altInfo.IsDir() {
-			// either this is an error OR it is nil because the directory is not a directory,
-			// so just skip it
+		hasRefs := false
+		if refsInfo, err := os.Lstat(filepath.Join(dirname, nameRefs)); err == nil && refsInfo.IsDir() {
+			hasRefs = true
+		}
+		hasIndex := false
+		if indexInfo, err := os.Stat(filepath.Join(dirname, nameIndex)); err == nil && indexInfo.Mode().IsRegular() {
+			hasIndex = true
+		}
+		if !hasRefs && !hasIndex {
+			// neither way to reference the blobs, so just skip it
 			return nil
 		}
 		if _, err := os.Stat(filepath.Join(dirname, nameLayout)); os.IsNotExist(err) {
@@ -131,7 +264,12 @@ func WalkForLayouts(rootpath string) (layouts Layouts, err error) {
 			return err
 		}
 		if _, ok := layouts[l]; !ok {
-			layouts[l] = &Layout{Root: rootpath, Name: l}
+			layout := &Layout{Root: rootpath, Name: l}
+			layout.Version, layout.VersionErr = layout.CheckVersion()
+			if layout.VersionErr != nil {
+				util.Debugf("%q has oci-layout version %q: %s", dirname, layout.Version, layout.VersionErr)
+			}
+			layouts[l] = layout
 		}
 		return nil
 	})
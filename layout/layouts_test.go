@@ -1,8 +1,13 @@
 package layout
 
 import (
-	"opencontainers/image-spec/specs-go/v1"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestWalk(t *testing.T) {
@@ -80,3 +85,284 @@ func TestWalk(t *testing.T) {
 		}
 	}
 }
+
+// newIndexLayout makes a image-spec 1.0 layout (`index.json`, no "refs"
+// directory) in a temporary directory, with the blobs of the tianon/true
+// testdata and the index entries provided. The caller is responsible for
+// removing the returned root.
+func newIndexLayout(t *testing.T, name string, index Index) (root string) {
+	root, err := ioutil.TempDir("", "test-layout.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := "../testdata/layouts/tianon/true"
+	dest := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Join(dest, nameBlobs, "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := ioutil.ReadDir(filepath.Join(src, nameBlobs, "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		buf, err := ioutil.ReadFile(filepath.Join(src, nameBlobs, "sha256", blob.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dest, nameBlobs, "sha256", blob.Name()), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, nameLayout), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	index.SchemaVersion = 2
+	buf, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, nameIndex), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+var trueManifest = v1.Descriptor{
+	MediaType: v1.MediaTypeImageManifest,
+	Digest:    "sha256:511b7324e54a838956ef67642f27de1a44785ef6305720495c8f15932d82e1b0",
+	Size:      421,
+}
+
+func TestWalkIndex(t *testing.T) {
+	root := newIndexLayout(t, "example.com/true", Index{
+		Manifests: []IndexDescriptor{
+			{Descriptor: trueManifest, Annotations: map[string]string{AnnotationRefName: "stable"}},
+			{Descriptor: trueManifest, Annotations: map[string]string{AnnotationRefName: "v1.0.0"}},
+			{Descriptor: trueManifest},
+		},
+	})
+	defer os.RemoveAll(root)
+
+	layouts, err := WalkForLayouts(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, ok := layouts["example.com/true"]
+	if !ok {
+		t.Fatalf("expected to find %q, but got %v", "example.com/true", layouts)
+	}
+
+	refs, err := layout.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRefs := []string{"stable", "v1.0.0"}
+	if len(refs) != len(expectedRefs) {
+		t.Fatalf("expected refs %q; got %q", expectedRefs, refs)
+	}
+	for i := range refs {
+		if refs[i] != expectedRefs[i] {
+			t.Errorf("expected ref %q; got %q", expectedRefs[i], refs[i])
+		}
+	}
+
+	desc, err := layout.GetRef("stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != trueManifest.Digest {
+		t.Errorf("expected %q; got %q", trueManifest.Digest, desc.Digest)
+	}
+	if _, err := ManifestFromDescriptor(layout, desc); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := layout.GetRef("nope"); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error; got %v", err)
+	}
+}
+
+func TestIndexRefPerPlatform(t *testing.T) {
+	s390x := v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    "sha256:3342106d17cf8fc913c462a27e792c09780fac1a34075098f8180398294c976a",
+		Size:      421,
+	}
+	root := newIndexLayout(t, "example.com/true", Index{
+		Manifests: []IndexDescriptor{
+			{
+				Descriptor:  s390x,
+				Platform:    &v1.Platform{OS: "linux", Architecture: "s390x"},
+				Annotations: map[string]string{AnnotationRefName: "stable"},
+			},
+			{
+				Descriptor:  trueManifest,
+				Platform:    &v1.Platform{OS: "linux", Architecture: "amd64"},
+				Annotations: map[string]string{AnnotationRefName: "stable"},
+			},
+		},
+	})
+	defer os.RemoveAll(root)
+	l := Layout{Root: root, Name: "example.com/true"}
+
+	refs, err := l.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0] != "stable" {
+		t.Errorf("expected only %q; got %q", "stable", refs)
+	}
+	for _, tc := range []struct {
+		platform string
+		expect   v1.Descriptor
+		err      error
+	}{
+		{"linux/amd64", trueManifest, nil},
+		{"linux/x86_64", trueManifest, nil},
+		{"linux/s390x", s390x, nil},
+		{"linux/arm64", v1.Descriptor{}, ErrNoMatchingPlatform},
+	} {
+		p, err := ParsePlatform(tc.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := l.GetRefForPlatform("stable", p)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v; got %v", tc.platform, tc.err, err)
+			continue
+		}
+		if err == nil && desc.Digest != tc.expect.Digest {
+			t.Errorf("%s: expected %q; got %q", tc.platform, tc.expect.Digest, desc.Digest)
+		}
+	}
+}
+
+func TestValidateRefName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"stable":                           true,
+		"v1.0.0":                           true,
+		"v1/beta":                          true,
+		"docker.io/library/busybox:latest": true,
+		"a--b":                             true,
+		"":                                 false,
+		"/stable":                          false,
+		"stable/":                          false,
+		"..":                               false,
+		"../../../../escaped":              false,
+		"v1/../../escaped":                 false,
+		"v1//beta":                         false,
+		".hidden":                          false,
+	} {
+		if err := ValidateRefName(name); (err == nil) != valid {
+			t.Errorf("%q: expected valid to be %t; got %v", name, valid, err)
+		}
+	}
+
+	root := newIndexLayout(t, "example.com/true", Index{
+		Manifests: []IndexDescriptor{
+			{Descriptor: trueManifest, Annotations: map[string]string{AnnotationRefName: "stable"}},
+			{Descriptor: trueManifest, Annotations: map[string]string{AnnotationRefName: "../../../../escaped"}},
+		},
+	})
+	defer os.RemoveAll(root)
+	l := Layout{Root: root, Name: "example.com/true"}
+	refs, err := l.Refs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0] != "stable" {
+		t.Errorf("expected only %q; got %q", "stable", refs)
+	}
+	if _, err := l.GetRef("../../../../escaped"); err == nil {
+		t.Error("expected an error for a ref name that is not valid")
+	}
+}
+
+func TestDockerMediaTypes(t *testing.T) {
+	root := newIndexLayout(t, "example.com/true", Index{})
+	defer os.RemoveAll(root)
+	l := &Layout{Root: root, Name: "example.com/true"}
+
+	manifest := addBlob(t, root, l.Name, MediaTypeDockerManifest, v1.Manifest{
+		Config: v1.Descriptor{
+			MediaType: MediaTypeDockerConfig,
+			Digest:    "sha256:aee91e3b71a73d8966c4710aeaff8f6814c6361c56cdefafbe2d57c3599b441a",
+			Size:      1478,
+		},
+		Layers: []v1.Descriptor{
+			{
+				MediaType: MediaTypeDockerLayer,
+				Digest:    "sha256:84d53425330b804574521345af5778e81714a707f6e9bc4743aceb985cf83d0f",
+				Size:      146,
+			},
+		},
+	})
+	list := addBlob(t, root, l.Name, MediaTypeDockerManifestList, Index{
+		Manifests: []IndexDescriptor{
+			{Descriptor: manifest, Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		},
+	})
+
+	for _, desc := range []v1.Descriptor{manifest, list} {
+		m, err := ManifestForPlatform(l, &desc, v1.Platform{OS: "linux", Architecture: "amd64"})
+		if err != nil {
+			t.Errorf("%s: %s", desc.MediaType, err)
+			continue
+		}
+		config, err := m.Config()
+		if err != nil {
+			t.Errorf("%s: %s", desc.MediaType, err)
+			continue
+		}
+		if config.ImageConfig.Config.Cmd[0] != "/true" {
+			t.Errorf("%s: expected Cmd of %q; got %q", desc.MediaType, "/true", config.ImageConfig.Config.Cmd)
+		}
+		if CanonicalMediaType(m.Manifest.Layers[0].MediaType) != v1.MediaTypeImageLayer {
+			t.Errorf("expected %q to be handled as %q", m.Manifest.Layers[0].MediaType, v1.MediaTypeImageLayer)
+		}
+	}
+
+	if CanonicalMediaType("application/vnd.example.unknown") != "" {
+		t.Errorf("expected unknown media types to not be supported")
+	}
+}
+
+func TestWalkLayoutVersions(t *testing.T) {
+	root := newIndexLayout(t, "example.com/good", Index{})
+	defer os.RemoveAll(root)
+	for name, content := range map[string]string{
+		"example.com/future":   `{"imageLayoutVersion": "2.0.0"}`,
+		"example.com/garbage":  `imageLayoutVersion=1.0.0`,
+		"example.com/noversio": `{}`,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, name, nameBlobs), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, name, nameIndex), []byte(`{"schemaVersion": 2}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, name, nameLayout), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layouts, err := WalkForLayouts(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layouts) != 4 {
+		t.Fatalf("expected 4 layouts; got %d", len(layouts))
+	}
+	if l := layouts["example.com/good"]; l.VersionErr != nil || l.Version != "1.0.0" {
+		t.Errorf("expected version 1.0.0; got %q (%v)", l.Version, l.VersionErr)
+	}
+	if l := layouts["example.com/future"]; l.VersionErr != ErrUnsupportedLayoutVersion || l.Version != "2.0.0" {
+		t.Errorf("expected %q for version %q; got %v", ErrUnsupportedLayoutVersion, l.Version, l.VersionErr)
+	}
+	if l := layouts["example.com/garbage"]; l.VersionErr == nil {
+		t.Errorf("expected an error for an unparsable oci-layout")
+	}
+	if l := layouts["example.com/noversio"]; l.VersionErr != ErrUnsupportedLayoutVersion {
+		t.Errorf("expected %q for a missing version; got %v", ErrUnsupportedLayoutVersion, l.VersionErr)
+	}
+}
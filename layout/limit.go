@@ -0,0 +1,55 @@
+package layout
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Limits on the blobs that are read into memory. A boot-time generator must
+// not be made to exhaust memory by a malformed or malicious layout.
+var (
+	// MaxManifestSize bounds the size of manifests, image indexes, the
+	// `index.json` and legacy refs.
+	MaxManifestSize int64 = 4 << 20
+	// MaxConfigSize bounds the size of image configs.
+	MaxConfigSize int64 = 4 << 20
+)
+
+// Errors for blobs that are not the size expected
+var (
+	ErrSizeMismatch = errors.New("blob size does not match its descriptor")
+	ErrBlobTooLarge = errors.New("blob exceeds the size limit")
+)
+
+// limitedReadCloser fails with ErrBlobTooLarge once more than max is read
+type limitedReadCloser struct {
+	io.Closer
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, ErrBlobTooLarge
+	}
+	return n, err
+}
+
+func limitBlob(rc io.ReadCloser, max int64) io.ReadCloser {
+	return &limitedReadCloser{Closer: rc, r: io.LimitReader(rc, max+1), max: max}
+}
+
+// readFileLimit is ioutil.ReadFile, for files no larger than max
+func readFileLimit(path string, max int64) ([]byte, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return ioutil.ReadAll(limitBlob(fh, max))
+}
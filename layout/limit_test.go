@@ -0,0 +1,60 @@
+package layout
+
+import (
+	"os"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBlobSizes(t *testing.T) {
+	root := newIndexLayout(t, "example.com/true", Index{})
+	defer os.RemoveAll(root)
+	l := &Layout{Root: root, Name: "example.com/true"}
+
+	if _, err := l.readBlob(DescriptorRef(l, trueManifest), MaxManifestSize); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongSize := trueManifest
+	wrongSize.Size++
+	if _, err := l.GetBlob(DescriptorRef(l, wrongSize)); err != ErrSizeMismatch {
+		t.Errorf("expected %q; got %v", ErrSizeMismatch, err)
+	}
+	if _, err := ManifestForPlatform(l, &wrongSize, HostPlatform()); err != ErrSizeMismatch {
+		t.Errorf("expected %q; got %v", ErrSizeMismatch, err)
+	}
+	// a descriptor of size 0, or none, is still checked
+	noSize := trueManifest
+	noSize.Size = 0
+	if _, err := l.GetBlob(DescriptorRef(l, noSize)); err != ErrSizeMismatch {
+		t.Errorf("expected %q for a descriptor without a size; got %v", ErrSizeMismatch, err)
+	}
+	invalid, err := l.InvalidBlobs(wrongSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invalid) != 1 {
+		t.Errorf("expected the manifest to be invalid; got %v", invalid)
+	}
+
+	// descriptors claiming to be large are refused before reading
+	tooLarge := trueManifest
+	tooLarge.Size = MaxManifestSize + 1
+	if _, err := l.readBlob(DescriptorRef(l, tooLarge), MaxManifestSize); err != ErrBlobTooLarge {
+		t.Errorf("expected %q; got %v", ErrBlobTooLarge, err)
+	}
+	// and blobs without a size are cut off at the limit
+	if _, err := l.readBlob(DigestRef{Name: trueManifest.Digest, Layout: l}, 100); err != ErrBlobTooLarge {
+		t.Errorf("expected %q; got %v", ErrBlobTooLarge, err)
+	}
+
+	m := Manifest{Layout: l, Manifest: &v1.Manifest{Config: v1.Descriptor{
+		MediaType: v1.MediaTypeImageConfig,
+		Digest:    "sha256:aee91e3b71a73d8966c4710aeaff8f6814c6361c56cdefafbe2d57c3599b441a",
+		Size:      MaxConfigSize + 1,
+	}}}
+	if _, err := m.Config(); err != ErrBlobTooLarge {
+		t.Errorf("expected %q; got %v", ErrBlobTooLarge, err)
+	}
+}
@@ -4,26 +4,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/oci-systemd-generator/util"
 )
 
 // Manifest carries the layout and ref name, plus the full structure for the
 // OCI image manifest
 type Manifest struct {
-	Layout   *Layout
-	Ref      string
-	Manifest *v1.Manifest
+	Layout     *Layout
+	Ref        string
+	Descriptor *v1.Descriptor // of this manifest, after resolving any image index
+	Manifest   *v1.Manifest
 }
 
 // ConfigReader gives access to the raw body of the config for this manifest.
+// Reading more than MaxConfigSize ends with ErrBlobTooLarge.
 // The caller is responsible to close the io.ReadCloser
 func (m Manifest) ConfigReader() (io.ReadCloser, error) {
-	if m.Manifest.Config.MediaType != v1.MediaTypeImageConfig {
+	if CanonicalMediaType(m.Manifest.Config.MediaType) != v1.MediaTypeImageConfig {
 		return nil, fmt.Errorf("expected %q; got %q", v1.MediaTypeImageConfig, m.Manifest.Config.MediaType)
 	}
-	digestRef := DigestRef{Name: m.Manifest.Config.Digest}
-	return m.Layout.GetBlob(digestRef)
+	if m.Manifest.Config.Size > MaxConfigSize {
+		return nil, ErrBlobTooLarge
+	}
+	fh, err := m.Layout.GetBlob(DescriptorRef(m.Layout, m.Manifest.Config))
+	if err != nil {
+		return nil, err
+	}
+	return limitBlob(fh, MaxConfigSize), nil
 }
 
 // Config provides the structure for this particular view of this layout
@@ -34,9 +44,13 @@ func (m *Manifest) Config() (*Config, error) {
 		return nil, err
 	}
 	defer configFH.Close()
-	dec := json.NewDecoder(configFH)
+	// read it all, for the blob to be verified
+	buf, err := ioutil.ReadAll(configFH)
+	if err != nil {
+		return nil, err
+	}
 	imageConfig := &v1.Image{}
-	if err := dec.Decode(imageConfig); err != nil {
+	if err := json.Unmarshal(buf, imageConfig); err != nil {
 		return nil, err
 	}
 
@@ -49,6 +63,24 @@ func (m *Manifest) Config() (*Config, error) {
 	return &config, nil
 }
 
+// InvalidBlobs gives the blobs of this manifest, its config and its layers,
+// that are missing or do not match their digest.
+func (m Manifest) InvalidBlobs() ([]DigestRef, error) {
+	if m.Descriptor == nil {
+		return nil, ErrObjectNil
+	}
+	return m.Layout.InvalidBlobs(*m.Descriptor)
+}
+
+// MissingBlobs is InvalidBlobs, but the layers are not hashed (see
+// Layout.MissingBlobs).
+func (m Manifest) MissingBlobs() ([]DigestRef, error) {
+	if m.Descriptor == nil {
+		return nil, ErrObjectNil
+	}
+	return m.Layout.MissingBlobs(*m.Descriptor)
+}
+
 // Some common errors
 var (
 	ErrObjectNil            = fmt.Errorf("object is nil")
@@ -56,26 +88,87 @@ var (
 )
 
 // ManifestFromDescriptor simplifies the reaching of manifest as the
-// descriptors are accessed
+// descriptors are accessed. An image index (manifest list) is resolved to the
+// manifest for the running host (see HostPlatform).
 func ManifestFromDescriptor(l *Layout, d *v1.Descriptor) (*Manifest, error) {
+	return ManifestForPlatform(l, d, HostPlatform())
+}
+
+// ManifestForPlatform is like ManifestFromDescriptor, but an image index
+// (including nested indexes) is resolved to the manifest that best matches
+// platform p.
+func ManifestForPlatform(l *Layout, d *v1.Descriptor, p v1.Platform) (*Manifest, error) {
 	if l == nil || d == nil {
 		return nil, ErrObjectNil
 	}
-	if d.MediaType != v1.MediaTypeImageManifest && d.MediaType != v1.MediaTypeImageManifestList {
+	desc, err := resolveIndex(l, *d, p, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := l.readBlob(DescriptorRef(l, *desc), MaxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	manifest := v1.Manifest{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, err
+	}
+	return &Manifest{Layout: l, Descriptor: desc, Manifest: &manifest}, nil
+}
+
+// maxIndexDepth bounds how deep image indexes may nest, so that a loop of
+// indexes can not recurse forever.
+const maxIndexDepth = 8
+
+// resolveIndex walks the image index d (if it is one) to the descriptor of
+// the manifest that best matches platform p.
+func resolveIndex(l *Layout, d v1.Descriptor, p v1.Platform, depth int) (*v1.Descriptor, error) {
+	switch CanonicalMediaType(d.MediaType) {
+	case v1.MediaTypeImageManifest:
+		return &d, nil
+	case v1.MediaTypeImageManifestList, MediaTypeImageIndex:
+	default:
 		return nil, ErrUnsupportedMediaType
 	}
-	if d.MediaType == v1.MediaTypeImageManifestList {
-		return nil, fmt.Errorf("TODO: add support for manifest list")
+	if depth >= maxIndexDepth {
+		return nil, fmt.Errorf("image index %q is nested more than %d deep", d.Digest, maxIndexDepth)
 	}
-	manifestFH, err := l.GetBlob(DigestRef{Name: d.Digest})
+
+	index, err := l.indexFromBlob(DescriptorRef(l, d))
 	if err != nil {
 		return nil, err
 	}
-	defer manifestFH.Close()
-	manifest := v1.Manifest{}
-	dec := json.NewDecoder(manifestFH)
-	if err := dec.Decode(&manifest); err != nil {
+	best, err := resolvePlatform(l, index.Manifests, p, depth+1)
+	if err != nil {
 		return nil, err
 	}
-	return &Manifest{Layout: l, Manifest: &manifest}, nil
+	util.Debugf("image index %q resolved to %q for %s", d.Digest, best.Digest, PlatformString(p))
+	return best, nil
+}
+
+// resolvePlatform picks the entry that best matches platform p (the first of
+// those that match equally well), resolved to its manifest. Entries that do not
+// resolve for p are passed over.
+func resolvePlatform(l *Layout, entries []IndexDescriptor, p v1.Platform, depth int) (*v1.Descriptor, error) {
+	var (
+		best      *v1.Descriptor
+		bestScore int
+	)
+	for _, entry := range entries {
+		score := matchPlatform(p, entry.Platform)
+		if score == 0 || score <= bestScore {
+			continue
+		}
+		desc, err := resolveIndex(l, entry.Descriptor, p, depth)
+		if err == ErrUnsupportedMediaType || err == ErrNoMatchingPlatform {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		best, bestScore = desc, score
+	}
+	if best == nil {
+		return nil, ErrNoMatchingPlatform
+	}
+	return best, nil
 }
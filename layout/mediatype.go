@@ -0,0 +1,65 @@
+package layout
+
+import "github.com/opencontainers/image-spec/specs-go/v1"
+
+// OCI layer media types beyond the gzip compressed ones of the image-spec
+// package.
+const (
+	MediaTypeImageLayerTar                  = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeImageLayerZstd                 = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeImageLayerNonDistributableTar  = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+// Media types of the Docker image manifest v2, schema 2. Images copied with
+// their original media types preserved carry these rather than the OCI ones.
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// MediaTypes is the registry of supported media types. Each is mapped onto
+// the OCI media type whose code path handles it.
+var MediaTypes = map[string]string{
+	v1.MediaTypeImageManifest:               v1.MediaTypeImageManifest,
+	v1.MediaTypeImageManifestList:           v1.MediaTypeImageManifestList,
+	MediaTypeImageIndex:                     MediaTypeImageIndex,
+	v1.MediaTypeImageConfig:                 v1.MediaTypeImageConfig,
+	v1.MediaTypeImageLayer:                  v1.MediaTypeImageLayer,
+	v1.MediaTypeImageLayerNonDistributable:  v1.MediaTypeImageLayerNonDistributable,
+	MediaTypeImageLayerTar:                  MediaTypeImageLayerTar,
+	MediaTypeImageLayerZstd:                 MediaTypeImageLayerZstd,
+	MediaTypeImageLayerNonDistributableTar:  MediaTypeImageLayerNonDistributableTar,
+	MediaTypeImageLayerNonDistributableZstd: MediaTypeImageLayerNonDistributableZstd,
+
+	MediaTypeDockerManifest:     v1.MediaTypeImageManifest,
+	MediaTypeDockerManifestList: v1.MediaTypeImageManifestList,
+	MediaTypeDockerConfig:       v1.MediaTypeImageConfig,
+	MediaTypeDockerLayer:        v1.MediaTypeImageLayer,
+	MediaTypeDockerForeignLayer: v1.MediaTypeImageLayerNonDistributable,
+}
+
+// RegisterMediaType adds mediaType to the registry, to be handled as though it
+// were the OCI media type ociMediaType.
+func RegisterMediaType(mediaType, ociMediaType string) {
+	MediaTypes[mediaType] = ociMediaType
+}
+
+// isLayer is whether mediaType is of a layer, rather than of an index, a
+// manifest or a config
+func isLayer(mediaType string) bool {
+	switch CanonicalMediaType(mediaType) {
+	case v1.MediaTypeImageManifest, v1.MediaTypeImageManifestList, MediaTypeImageIndex, v1.MediaTypeImageConfig:
+		return false
+	}
+	return true
+}
+
+// CanonicalMediaType is the OCI media type that handles mediaType, or an
+// empty string if it is not supported.
+func CanonicalMediaType(mediaType string) string {
+	return MediaTypes[mediaType]
+}
@@ -0,0 +1,138 @@
+package layout
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrNoMatchingPlatform is returned when none of the manifests in an image
+// index are for the platform requested.
+var ErrNoMatchingPlatform = fmt.Errorf("no manifest matching the platform")
+
+// HostPlatform is the platform of the running host, used to select a manifest
+// from an image index.
+func HostPlatform() v1.Platform {
+	return v1.Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Variant:      hostVariant(),
+	}
+}
+
+// ParsePlatform reads a platform in the form of "os/arch[/variant]" (e.g.
+// "linux/arm64/v8").
+func ParsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("expected platform as os/arch[/variant]; got %q", s)
+	}
+	p := v1.Platform{
+		OS:           strings.ToLower(parts[0]),
+		Architecture: normalizeArch(parts[1]),
+	}
+	if len(parts) == 3 {
+		p.Variant = normalizeVariant(p.Architecture, parts[2])
+	}
+	return p, nil
+}
+
+// PlatformString is the reverse of ParsePlatform
+func PlatformString(p v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matchPlatform scores how well the platform of an index entry (`have`)
+// satisfies the platform wanted. Zero is no match, and higher is better.
+func matchPlatform(want v1.Platform, have *v1.Platform) int {
+	if have == nil {
+		// entries without a platform are only picked when nothing else is
+		return 1
+	}
+	if !strings.EqualFold(want.OS, have.OS) {
+		return 0
+	}
+	arch := normalizeArch(want.Architecture)
+	if arch != normalizeArch(have.Architecture) {
+		return 0
+	}
+	wantVariant := normalizeVariant(arch, want.Variant)
+	haveVariant := normalizeVariant(arch, have.Variant)
+	switch {
+	case wantVariant == haveVariant:
+		return 4
+	case haveVariant == "":
+		return 3
+	case arch == "arm" && wantVariant > haveVariant:
+		// an armv7 host runs armv6 and armv5 binaries
+		return 2
+	}
+	return 0
+}
+
+func normalizeArch(arch string) string {
+	arch = strings.ToLower(arch)
+	switch arch {
+	case "x86_64", "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "i386", "i686":
+		return "386"
+	}
+	return arch
+}
+
+func normalizeVariant(arch, variant string) string {
+	variant = strings.ToLower(variant)
+	if variant != "" && !strings.HasPrefix(variant, "v") && (arch == "arm" || arch == "arm64") {
+		variant = "v" + variant
+	}
+	if arch == "arm64" && variant == "" {
+		return "v8"
+	}
+	return variant
+}
+
+// hostVariant is only meaningful for arm, where the variant is read from the
+// "CPU architecture" in /proc/cpuinfo.
+func hostVariant() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "v8"
+	case "arm":
+	default:
+		return ""
+	}
+	fh, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		chunks := strings.SplitN(scanner.Text(), ":", 2)
+		if len(chunks) != 2 || strings.TrimSpace(chunks[0]) != "CPU architecture" {
+			continue
+		}
+		switch strings.TrimSpace(chunks[1]) {
+		case "8", "AArch64":
+			return "v8"
+		case "7":
+			return "v7"
+		case "6":
+			return "v6"
+		case "5", "5TE", "5TEJ":
+			return "v5"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package layout
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		expect v1.Platform
+		fail   bool
+	}{
+		{in: "linux/amd64", expect: v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{in: "linux/x86_64", expect: v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{in: "linux/arm/7", expect: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{in: "Linux/aarch64/v8", expect: v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{in: "linux", fail: true},
+		{in: "linux//v7", fail: true},
+		{in: "linux/arm/v7/extra", fail: true},
+	} {
+		got, err := ParsePlatform(tc.in)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error, but got %#v", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.in, err)
+			continue
+		}
+		if PlatformString(got) != PlatformString(tc.expect) {
+			t.Errorf("%q: expected %q; got %q", tc.in, PlatformString(tc.expect), PlatformString(got))
+		}
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	armv7 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	for _, tc := range []struct {
+		want   v1.Platform
+		have   *v1.Platform
+		expect int
+	}{
+		{armv7, nil, 1},
+		{armv7, &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, 4},
+		{armv7, &v1.Platform{OS: "linux", Architecture: "arm"}, 3},
+		{armv7, &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, 2},
+		{armv7, &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v8"}, 0},
+		{armv7, &v1.Platform{OS: "linux", Architecture: "arm64"}, 0},
+		{armv7, &v1.Platform{OS: "windows", Architecture: "arm", Variant: "v7"}, 0},
+		{v1.Platform{OS: "linux", Architecture: "arm64"}, &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, 4},
+		{v1.Platform{OS: "linux", Architecture: "amd64"}, &v1.Platform{OS: "linux", Architecture: "x86_64"}, 4},
+	} {
+		if got := matchPlatform(tc.want, tc.have); got != tc.expect {
+			t.Errorf("%s matching %#v: expected %d; got %d", PlatformString(tc.want), tc.have, tc.expect, got)
+		}
+	}
+}
+
+// addBlob writes the JSON of v as a blob in the layout at root/name, and
+// returns its descriptor.
+func addBlob(t *testing.T, root, name, mediaType string, v interface{}) v1.Descriptor {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(buf))
+	if err := ioutil.WriteFile(filepath.Join(root, name, nameBlobs, "sha256", sum), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return v1.Descriptor{MediaType: mediaType, Digest: "sha256:" + sum, Size: int64(len(buf))}
+}
+
+func TestResolveIndex(t *testing.T) {
+	root := newIndexLayout(t, "example.com/true", Index{})
+	defer os.RemoveAll(root)
+	l := &Layout{Root: root, Name: "example.com/true"}
+
+	fake := func(n int) v1.Descriptor {
+		return v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: fmt.Sprintf("sha256:%064d", n)}
+	}
+	nested := addBlob(t, root, l.Name, MediaTypeImageIndex, Index{
+		Manifests: []IndexDescriptor{
+			{Descriptor: fake(3), Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+			{Descriptor: fake(4), Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		},
+	})
+	top := addBlob(t, root, l.Name, MediaTypeImageIndex, Index{
+		Manifests: []IndexDescriptor{
+			{Descriptor: fake(1), Platform: &v1.Platform{OS: "linux", Architecture: "s390x"}},
+			{Descriptor: trueManifest, Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+			{Descriptor: fake(2), Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+			{Descriptor: nested},
+		},
+	})
+
+	for platform, expect := range map[string]string{
+		"linux/s390x":   fake(1).Digest,
+		"linux/amd64":   trueManifest.Digest,
+		"linux/arm64":   fake(2).Digest,
+		"linux/arm/v7":  fake(4).Digest,
+		"linux/arm/v6":  fake(3).Digest,
+		"linux/ppc64le": "",
+	} {
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := resolveIndex(l, top, p, 0)
+		if expect == "" {
+			if err != ErrNoMatchingPlatform {
+				t.Errorf("%s: expected %q; got %v", platform, ErrNoMatchingPlatform, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", platform, err)
+			continue
+		}
+		if desc.Digest != expect {
+			t.Errorf("%s: expected %q; got %q", platform, expect, desc.Digest)
+		}
+	}
+
+	m, err := ManifestForPlatform(l, &top, v1.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Manifest.Config.Digest != "sha256:aee91e3b71a73d8966c4710aeaff8f6814c6361c56cdefafbe2d57c3599b441a" {
+		t.Errorf("unexpected config %q", m.Manifest.Config.Digest)
+	}
+}
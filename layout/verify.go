@@ -0,0 +1,201 @@
+package layout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vbatts/oci-systemd-generator/util"
+)
+
+// ErrDigestMismatch is returned, in place of io.EOF, at the end of reading a
+// blob whose content does not match its digest.
+var ErrDigestMismatch = errors.New("blob content does not match its digest")
+
+// verifyingReader hashes a blob as it is read, and checks the sum at EOF
+type verifyingReader struct {
+	fh     *os.File
+	h      hash.Hash
+	digest DigestRef
+	cache  *BlobCache
+	info   os.FileInfo
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.fh.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if fmt.Sprintf("%x", v.h.Sum(nil)) != v.digest.Sum() {
+			util.Debugf("blob %q failed verification", v.digest.Name)
+			return n, ErrDigestMismatch
+		}
+		if cerr := v.cache.Add(v.digest, v.fh.Name(), v.info); cerr != nil {
+			util.Debugf("failed to cache verification of %q: %s", v.digest.Name, cerr)
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.fh.Close()
+}
+
+// BlobCache records the blobs that have passed verification, keyed by their
+// digest, size and modification time, so that blobs which have not changed
+// are not hashed again on every run.
+// A nil *BlobCache is valid, and caches nothing.
+type BlobCache struct {
+	Path string
+}
+
+type blobCacheEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // unix nanoseconds
+}
+
+// Verified is whether the blob at path has already been verified as digest,
+// and has not since changed.
+func (c *BlobCache) Verified(digest DigestRef, path string, info os.FileInfo) bool {
+	if c == nil {
+		return false
+	}
+	entries, err := c.entries(digest)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.Path == path && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records that the blob at path has been verified as digest
+func (c *BlobCache) Add(digest DigestRef, path string, info os.FileInfo) error {
+	if c == nil {
+		return nil
+	}
+	entryPath := c.entryPath(digest)
+	if entryPath == "" {
+		return fmt.Errorf("invalid digest %q", digest.Name)
+	}
+	entries, err := c.entries(digest)
+	if err != nil && !os.IsNotExist(err) {
+		// the entries are only a cache, so start over
+		entries = nil
+	}
+	updated := []blobCacheEntry{{Path: path, Size: info.Size(), ModTime: info.ModTime().UnixNano()}}
+	for _, entry := range entries {
+		if entry.Path != path {
+			updated = append(updated, entry)
+		}
+	}
+	return c.write(entryPath, updated)
+}
+
+// Prune removes the entries of blobs that are no longer at their path, and
+// returns the paths of the digests' records that were removed as none of
+// their blobs remain. With dryRun, nothing is changed.
+func (c *BlobCache) Prune(dryRun bool) ([]string, error) {
+	removed := []string{}
+	if c == nil {
+		return removed, nil
+	}
+	// <hashName>/<sum>
+	matches, err := filepath.Glob(filepath.Join(c.Path, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, entryPath := range matches {
+		digest := pathToDigest(strings.TrimPrefix(entryPath, c.Path+"/"))
+		if digest == nil {
+			// not a record, like the temporary file of an Add
+			continue
+		}
+		// an unreadable record is removed, as it is of no use to Verified
+		entries, _ := c.entries(*digest)
+		remaining := []blobCacheEntry{}
+		for _, entry := range entries {
+			if _, err := os.Stat(entry.Path); err == nil {
+				remaining = append(remaining, entry)
+			}
+		}
+		if len(remaining) == len(entries) && len(entries) > 0 {
+			continue
+		}
+		if dryRun {
+			if len(remaining) == 0 {
+				removed = append(removed, entryPath)
+			}
+			continue
+		}
+		if len(remaining) > 0 {
+			if err := c.write(entryPath, remaining); err != nil {
+				return removed, err
+			}
+			continue
+		}
+		if err := os.Remove(entryPath); err != nil {
+			return removed, err
+		}
+		removed = append(removed, entryPath)
+	}
+	return removed, nil
+}
+
+// write replaces the record at entryPath with entries
+func (c *BlobCache) write(entryPath string, entries []blobCacheEntry) error {
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0755); err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(entryPath), ".tmp.")
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(buf); err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	return os.Rename(fh.Name(), entryPath)
+}
+
+func (c *BlobCache) entries(digest DigestRef) ([]blobCacheEntry, error) {
+	entryPath := c.entryPath(digest)
+	if entryPath == "" {
+		return nil, os.ErrNotExist
+	}
+	buf, err := ioutil.ReadFile(entryPath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []blobCacheEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *BlobCache) entryPath(digest DigestRef) string {
+	p := digestToPath(digest)
+	if p == "" {
+		return ""
+	}
+	return filepath.Join(c.Path, p)
+}
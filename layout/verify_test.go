@@ -0,0 +1,152 @@
+package layout
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyingGetBlob(t *testing.T) {
+	root := newIndexLayout(t, "example.com/true", Index{})
+	defer os.RemoveAll(root)
+	cacheDir, err := ioutil.TempDir("", "test-cache.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	l := &Layout{Root: root, Name: "example.com/true", Cache: &BlobCache{Path: cacheDir}}
+	digest := DigestRef{Name: trueManifest.Digest, Layout: l}
+
+	// an intact blob reads to EOF, and is cached
+	fh, err := l.GetBlob(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, fh); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	info, err := os.Stat(l.blobPath(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Cache.Verified(digest, l.blobPath(digest), info) {
+		t.Errorf("expected %q to be cached as verified", digest.Name)
+	}
+
+	// tamper with the blob, but keep the size and mtime. The cache is trusted.
+	buf, err := ioutil.ReadFile(l.blobPath(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = ' '
+	if err := ioutil.WriteFile(l.blobPath(digest), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(l.blobPath(digest), info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := digest.IsValid(); err != nil || !valid {
+		t.Errorf("expected the cached blob to be valid; got %t, %v", valid, err)
+	}
+
+	// once the mtime changes, it is hashed again and fails at EOF
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(l.blobPath(digest), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := digest.IsValid(); err != nil || valid {
+		t.Errorf("expected the tampered blob to be invalid; got %t, %v", valid, err)
+	}
+	fh, err = l.GetBlob(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err := ioutil.ReadAll(fh); err != ErrDigestMismatch {
+		t.Errorf("expected %q; got %v", ErrDigestMismatch, err)
+	}
+	if _, err := l.readBlob(digest, MaxManifestSize); err != ErrDigestMismatch {
+		t.Errorf("expected %q; got %v", ErrDigestMismatch, err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "sha256")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBlobCachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-cache.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &BlobCache{Path: filepath.Join(dir, "verified")}
+	blob := func(name, sum string) (DigestRef, string) {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := DigestRef{Name: "sha256:" + sum}
+		if err := c.Add(digest, path, info); err != nil {
+			t.Fatal(err)
+		}
+		return digest, path
+	}
+	kept, _ := blob("kept", "1111111111111111111111111111111111111111111111111111111111111111")
+	gone, gonePath := blob("gone", "2222222222222222222222222222222222222222222222222222222222222222")
+	// the same blob in two layouts, one of which is removed
+	shared, sharedPath := blob("shared-a", "3333333333333333333333333333333333333333333333333333333333333333")
+	if err := os.Link(sharedPath, filepath.Join(dir, "shared-b")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "shared-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(shared, filepath.Join(dir, "shared-b"), info); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{gonePath, sharedPath} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := c.Prune(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != c.entryPath(gone) {
+		t.Errorf("expected only %q to be removed; got %v", c.entryPath(gone), removed)
+	}
+	if _, err := os.Stat(c.entryPath(gone)); err != nil {
+		t.Errorf("expected %q to be left by a dry run; got %v", c.entryPath(gone), err)
+	}
+
+	if removed, err = c.Prune(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != c.entryPath(gone) {
+		t.Errorf("expected only %q to be removed; got %v", c.entryPath(gone), removed)
+	}
+	if _, err := os.Stat(c.entryPath(gone)); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be removed; got %v", c.entryPath(gone), err)
+	}
+	if _, err := os.Stat(c.entryPath(kept)); err != nil {
+		t.Error(err)
+	}
+	entries, err := c.entries(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != filepath.Join(dir, "shared-b") {
+		t.Errorf("expected only the entry of the remaining blob; got %v", entries)
+	}
+}
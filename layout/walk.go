@@ -0,0 +1,107 @@
+package layout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrSkipDescriptor is returned by a WalkFunc to not descend into the
+// children of the descriptor it was called for.
+var ErrSkipDescriptor = errors.New("skip this descriptor")
+
+// WalkFunc is called by Walk for each descriptor reached. Platform is set for
+// the entries of an image index that have one, and depth is the distance from
+// the root descriptor.
+type WalkFunc func(d v1.Descriptor, platform *v1.Platform, depth int) error
+
+// Walk visits the graph of descriptors reachable from root: an image index to
+// its manifests (and nested indexes), and a manifest to its config and
+// layers. The children of a descriptor are read only after fn has been called
+// for it.
+func (l *Layout) Walk(root v1.Descriptor, fn WalkFunc) error {
+	return l.walk(root, nil, 0, fn)
+}
+
+func (l *Layout) walk(d v1.Descriptor, platform *v1.Platform, depth int, fn WalkFunc) error {
+	if depth > maxIndexDepth {
+		return fmt.Errorf("descriptor %q is nested more than %d deep", d.Digest, maxIndexDepth)
+	}
+	if err := fn(d, platform, depth); err != nil {
+		if err == ErrSkipDescriptor {
+			return nil
+		}
+		return err
+	}
+
+	switch CanonicalMediaType(d.MediaType) {
+	case v1.MediaTypeImageManifest:
+		buf, err := l.readBlob(DescriptorRef(l, d), MaxManifestSize)
+		if err != nil {
+			return err
+		}
+		var manifest v1.Manifest
+		if err := json.Unmarshal(buf, &manifest); err != nil {
+			return err
+		}
+		for _, child := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := l.walk(child, nil, depth+1, fn); err != nil {
+				return err
+			}
+		}
+	case v1.MediaTypeImageManifestList, MediaTypeImageIndex:
+		index, err := l.indexFromBlob(DescriptorRef(l, d))
+		if err != nil {
+			return err
+		}
+		for _, child := range index.Manifests {
+			if err := l.walk(child.Descriptor, child.Platform, depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// InvalidBlobs checks every blob reachable from root (see Walk), and gives
+// those that are missing or do not match their digest or size. The children of an
+// invalid blob are not checked.
+func (l *Layout) InvalidBlobs(root v1.Descriptor) ([]DigestRef, error) {
+	return l.invalidBlobs(root, true)
+}
+
+// MissingBlobs is InvalidBlobs, but layers are only checked to be there and of
+// their size, not hashed. They are verified as they are read to be extracted
+// (see GetBlob), rather than read twice.
+func (l *Layout) MissingBlobs(root v1.Descriptor) ([]DigestRef, error) {
+	return l.invalidBlobs(root, false)
+}
+
+func (l *Layout) invalidBlobs(root v1.Descriptor, hashLayers bool) ([]DigestRef, error) {
+	invalid := []DigestRef{}
+	err := l.Walk(root, func(d v1.Descriptor, _ *v1.Platform, _ int) error {
+		digest := DescriptorRef(l, d)
+		var valid bool
+		var err error
+		if hashLayers || !isLayer(d.MediaType) {
+			valid, err = digest.IsValid()
+		} else {
+			valid, err = digest.exists()
+		}
+		if err != nil && !os.IsNotExist(err) && err != ErrSizeMismatch {
+			return err
+		}
+		if !valid {
+			invalid = append(invalid, digest)
+			return ErrSkipDescriptor
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invalid, nil
+}
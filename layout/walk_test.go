@@ -0,0 +1,79 @@
+package layout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWalkDescriptors(t *testing.T) {
+	root := newIndexLayout(t, "example.com/true", Index{})
+	defer os.RemoveAll(root)
+	l := &Layout{Root: root, Name: "example.com/true"}
+	index := addBlob(t, root, l.Name, MediaTypeImageIndex, Index{
+		Manifests: []IndexDescriptor{
+			{Descriptor: trueManifest, Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		},
+	})
+
+	seen := []string{}
+	err := l.Walk(index, func(d v1.Descriptor, p *v1.Platform, depth int) error {
+		if d.Digest == trueManifest.Digest && (p == nil || p.Architecture != "amd64" || depth != 1) {
+			t.Errorf("expected the manifest at depth 1 with its platform; got %d, %#v", depth, p)
+		}
+		seen = append(seen, d.Digest)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 4 {
+		t.Errorf("expected index, manifest, config and layer; got %q", seen)
+	}
+
+	// a garbage blob that nothing references does not matter
+	if err := ioutil.WriteFile(filepath.Join(root, l.Name, nameBlobs, "sha256", "0000000000000000000000000000000000000000000000000000000000000000"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := l.InvalidBlobs(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invalid) != 0 {
+		t.Errorf("expected no invalid blobs; got %v", invalid)
+	}
+
+	// but a missing layer does
+	layer := "sha256:84d53425330b804574521345af5778e81714a707f6e9bc4743aceb985cf83d0f"
+	if err := os.Remove(l.blobPath(DigestRef{Name: layer})); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ManifestForPlatform(l, &index, v1.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err = m.InvalidBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invalid) != 1 || invalid[0].Name != layer {
+		t.Errorf("expected only %q to be invalid; got %v", layer, invalid)
+	}
+	if invalid, err := m.MissingBlobs(); err != nil || len(invalid) != 1 || invalid[0].Name != layer {
+		t.Errorf("expected only %q to be missing; got %v (%v)", layer, invalid, err)
+	}
+
+	// a corrupt layer is not hashed by MissingBlobs, but when it is read
+	if err := ioutil.WriteFile(l.blobPath(DigestRef{Name: layer}), make([]byte, m.Manifest.Layers[0].Size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if invalid, err := m.MissingBlobs(); err != nil || len(invalid) != 0 {
+		t.Errorf("expected no missing blobs; got %v (%v)", invalid, err)
+	}
+	if invalid, err := m.InvalidBlobs(); err != nil || len(invalid) != 1 || invalid[0].Name != layer {
+		t.Errorf("expected only %q to be invalid; got %v (%v)", layer, invalid, err)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	gounit "github.com/coreos/go-systemd/unit"
 	"github.com/vbatts/oci-systemd-generator/config"
 	"github.com/vbatts/oci-systemd-generator/extract"
 	"github.com/vbatts/oci-systemd-generator/layout"
@@ -20,6 +22,12 @@ var (
 	flConfig   = flag.String("config", "/etc/oci-generator.conf", "configuration for source directory of OCI image-layouts")
 	flGenerate = flag.Bool("generate", false, "output a generic configuration file content")
 	flDebug    = flag.Bool("debug", false, "enable debug output")
+
+	flRollback   = flag.String("rollback", "", "roll back the extracted `name:ref` to a previous generation, then exit")
+	flGeneration = flag.Int("generation", 0, "generation to roll back to, with -rollback (default is the one before the current)")
+
+	flGC       = flag.Bool("gc", false, "remove what is no longer used from the extracts directory, then exit")
+	flGCDryRun = flag.Bool("gc-dry-run", false, "report what -gc would remove, then exit")
 )
 
 func main() {
@@ -71,9 +79,45 @@ func main() {
 			fh.Close()
 		}
 	}
-	util.Debugf("cfg: %q", cfg)
+	util.Debugf("cfg: %+v", cfg)
+	if cfg.Generations > 0 {
+		extract.KeepGenerations = cfg.Generations
+	}
+	if cfg.LockTimeout > 0 {
+		extract.LockTimeout = cfg.LockTimeout
+	}
+	extract.StrictMetadata = cfg.StrictMetadata
+	if cfg.Rootless {
+		extract.Rootless = true
+	}
+	for name, spec := range cfg.IDMaps {
+		if extract.IDMaps[name], err = extract.ParseIDMap(spec); err != nil {
+			finalErr = fmt.Errorf("idmap of %q: %s", name, err)
+			return
+		}
+	}
+	if cfg.Storage != "" {
+		extract.DefaultStorage, err = extract.ParseStorage(cfg.Storage)
+		if err != nil {
+			finalErr = err
+			return
+		}
+	}
+	if cfg.CloneMode != "" {
+		extract.DefaultCloneMode, err = extract.ParseCloneMode(cfg.CloneMode)
+		if err != nil {
+			finalErr = err
+			return
+		}
+	}
 
-	// Walk cfg.ImageLayoutDir to find directories that have a refs and blobs dir
+	if *flRollback != "" {
+		finalErr = rollback(cfg.ExtractsDir, *flRollback, *flGeneration)
+		return
+	}
+
+	// Walk cfg.ImageLayoutDir to find directories that have blobs, and an
+	// index.json or refs dir
 	var layouts layout.Layouts
 	layouts, err = layout.WalkForLayouts(cfg.ImageLayoutDir)
 	if err != nil {
@@ -81,63 +125,91 @@ func main() {
 		return
 	}
 
+	if *flGC || *flGCDryRun {
+		finalErr = gc(cfg, layouts, *flGCDryRun)
+		return
+	}
+
+	// The platform to pick from image indexes (manifest lists)
+	platform := layout.HostPlatform()
+	if cfg.Platform != "" {
+		platform, err = layout.ParsePlatform(cfg.Platform)
+		if err != nil {
+			finalErr = err
+			return
+		}
+	}
+	util.Debugf("platform: %s", layout.PlatformString(platform))
+
+	// Blobs are verified as they are read, and those verified are cached (by
+	// digest, size and mtime) so they are not hashed again on the next run.
+	blobCache := &layout.BlobCache{Path: filepath.Join(cfg.ExtractsDir, "verified")}
+
 	// Check all the layouts available
 	manifests := []*layout.Manifest{}
-layoutLoop:
 	for name, l := range layouts {
+		l.Cache = blobCache
+		util.Debugf(name)
 		// Check the OCI layout version
-		if _, err := os.Stat(filepath.Join(cfg.ImageLayoutDir, name, "oci-layout")); os.IsNotExist(err) {
-			fmt.Printf("WARN: %q does not have an oci-layout file\n", name)
-		}
-		refs, err := l.Refs()
-		if err != nil {
+		if l.VersionErr != nil {
+			util.Debugf("\toci-layout version: %q (%s)", l.Version, l.VersionErr)
+			fmt.Printf("WARN: skipping %q: %s\n", name, l.VersionErr)
 			continue
 		}
-		blobs, err := l.Blobs()
+		util.Debugf("\toci-layout version: %q", l.Version)
+		refs, err := l.Refs()
 		if err != nil {
 			continue
 		}
-		util.Debugf(name)
-		util.Debugf("\tnum blobs: %d", len(blobs))
-		allValid := true
-		for _, blob := range blobs {
-			valid, err := blob.IsValid()
-			if err != nil {
-				break
-			}
-			if !valid {
-				util.Debugf("\tblob failed: %q", blob.Name)
-				allValid = false
-			}
-		}
-		if allValid {
-			util.Debugf("\tblob checksums: PASS")
-		} else {
-			util.Debugf("\tblob checksums: FAILED")
-			continue layoutLoop
-		}
-
 		util.Debugf("\trefs:")
 		for _, ref := range refs {
-			desc, err := l.GetRef(ref)
+			desc, err := l.GetRefForPlatform(ref, platform)
 			if err != nil {
+				log.Printf("%q: %s", ref, err)
 				continue
 			}
 			util.Debugf("\t\t%s: %#v", ref, desc)
-			manifest, err := layout.ManifestFromDescriptor(l, desc)
+			manifest, err := layout.ManifestForPlatform(l, desc, platform)
+			if err != nil {
+				log.Printf("%q: %s", ref, err)
+				continue
+			}
+
+			// Only the blobs reachable from this ref need to be intact for it to
+			// be used. A bad blob elsewhere in the layout does not matter here.
+			// Layers are verified as they are extracted, so they are only
+			// checked to be there.
+			invalid, err := manifest.MissingBlobs()
 			if err != nil {
-				if err == layout.ErrUnsupportedMediaType {
-					log.Println(err)
-					continue
-				}
 				log.Printf("%q: %s", ref, err)
-				break
+				continue
+			}
+			if len(invalid) > 0 {
+				for _, blob := range invalid {
+					util.Debugf("\t\tblob failed: %q", blob.Name)
+				}
+				util.Debugf("\t\tblob checksums: FAILED")
+				log.Printf("%q: %d blobs missing or failed verification", ref, len(invalid))
+				continue
 			}
+			util.Debugf("\t\tblob checksums: PASS")
+
 			manifest.Ref = ref
 			manifests = append(manifests, manifest)
 		}
 	}
 
+	// An extraction interrupted (e.g. by power loss) leaves an incomplete
+	// chainID dir, which must not be used.
+	removed, err := extract.CleanIncomplete(cfg.ExtractsDir)
+	if err != nil {
+		finalErr = err
+		return
+	}
+	for _, path := range removed {
+		util.Debugf("removed incomplete extract %q", path)
+	}
+
 	extractedLayouts, err := extract.WalkForExtracts(cfg.ExtractsDir)
 	if err != nil && err != extract.ErrNoExtracts {
 		finalErr = err
@@ -151,13 +223,39 @@ layoutLoop:
 		return
 	}
 	util.Debugf("%d to be extracted", len(toBeExtracted))
-	for _, m := range toBeExtracted {
-		layout, err := extract.Extract(cfg.ExtractsDir, m)
-		if err != nil {
-			finalErr = err
-			return
+	for _, result := range extract.ExtractAll(cfg.ExtractsDir, toBeExtracted, cfg.Workers) {
+		if result.Err != nil {
+			// the rest are reported, but the first (in order) is what fails
+			log.Printf("%s/%s: %s", result.Manifest.Layout.Name, result.Manifest.Ref, result.Err)
+			if finalErr == nil {
+				finalErr = result.Err
+			}
+			continue
+		}
+		if n := len(result.Metadata); n > 0 {
+			fmt.Printf("[WARN] image %s/%s: the metadata of %d of its files could not be applied, like %s\n", result.Manifest.Layout.Name, result.Manifest.Ref, n, result.Metadata[0])
+			for _, merr := range result.Metadata {
+				util.Debugf("\t%s", merr)
+			}
+		}
+		if n := len(result.Devices); n > 0 {
+			fmt.Printf("[WARN] image %s/%s: %d device nodes were not created rootless, like %s\n", result.Manifest.Layout.Name, result.Manifest.Ref, n, result.Devices[0])
+			for _, dev := range result.Devices {
+				util.Debugf("\t%s", dev)
+			}
+		}
+		known := false
+		for _, el := range extractedLayouts {
+			if el.Name == result.Layout.Name {
+				known = true
+			}
 		}
-		extractedLayouts = append(extractedLayouts, layout)
+		if !known {
+			extractedLayouts = append(extractedLayouts, result.Layout)
+		}
+	}
+	if finalErr != nil {
+		return
 	}
 
 	// If it has been extracted, check the config's ExecStart()
@@ -191,6 +289,8 @@ layoutLoop:
 	// 1) name (for .service unit file)
 	// 2) root directory
 	// 3) an ExecStart=
+	// 4) its image layout and ref are still present (unless keeping orphans)
+	orphans := 0
 	for _, el := range extractedLayouts {
 		refs, err := el.Refs()
 		if err != nil {
@@ -198,6 +298,14 @@ layoutLoop:
 			return
 		}
 		for _, ref := range refs {
+			if ref.Orphaned(layouts) {
+				orphans++
+				if !cfg.KeepOrphans {
+					fmt.Printf("[INFO] skipping image %s/%s. Orphaned, as it is no longer in %s\n", el.Name, ref.Name, cfg.ImageLayoutDir)
+					continue
+				}
+				fmt.Printf("[INFO] image %s/%s is orphaned, as it is no longer in %s. Keeping it.\n", el.Name, ref.Name, cfg.ImageLayoutDir)
+			}
 			config, err := ref.Config()
 			if err != nil {
 				finalErr = err
@@ -216,27 +324,116 @@ layoutLoop:
 				return
 			}
 			units = append(units, u)
-			u, err = unit.RootDirectory(ref.RootFS())
+
+			// the rootfs may be mounted (like overlayfs) by a .mount unit that
+			// the service depends on
+			mnt, err := ref.Mount()
 			if err != nil {
-				finalErr = err
-				return
+				// rather than a unit that fails to mount at boot. The rest are
+				// still generated, but the first is what fails.
+				log.Printf("%s/%s: %s", el.Name, ref.Name, err)
+				if finalErr == nil {
+					finalErr = err
+				}
+				continue
+			}
+			if mnt.Type != "" {
+				mount, err := unit.Mount(mnt.Source, mnt.Where, mnt.Type, strings.Join(mnt.Options, ","))
+				if err != nil {
+					finalErr = err
+					return
+				}
+				if err := writeUnit(dirNormal, unit.MountName(mnt.Where), mount); err != nil {
+					finalErr = err
+					return
+				}
+				units = append(units, unit.Requires(unit.MountName(mnt.Where))...)
 			}
-			units = append(units, u)
 
-			r := unit.Serialize(units)
-			filename := filepath.Join(dirNormal, ref.ReverseDomainNotation()+".service")
-			fh, err := os.Create(filename)
+			u, err = unit.RootDirectory(mnt.Where)
 			if err != nil {
 				finalErr = err
 				return
 			}
-			if _, err := io.Copy(fh, r); err != nil {
-				fh.Close()
+			units = append(units, u)
+
+			if err := writeUnit(dirNormal, ref.ReverseDomainNotation()+".service", units); err != nil {
 				finalErr = err
 				return
 			}
-			fh.Close()
-			fmt.Printf("wrote %q\n", filename)
 		}
 	}
+	if orphans > 0 {
+		fmt.Printf("INFO: %d orphaned extracts. See -gc to remove them.\n", orphans)
+	}
+}
+
+// writeUnit writes the unit file name to dir
+func writeUnit(dir, name string, units []*gounit.UnitOption) error {
+	filename := filepath.Join(dir, name)
+	fh, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, unit.Serialize(units)); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %q\n", filename)
+	return nil
+}
+
+// rollback links the extracted ref of nameRef (`name:ref`) to generation n
+func rollback(extractsDir, nameRef string, n int) error {
+	i := strings.LastIndex(nameRef, ":")
+	if i < 1 || i == len(nameRef)-1 {
+		return fmt.Errorf("expected name:ref to roll back; got %q", nameRef)
+	}
+	el := &extract.Layout{Root: extractsDir, Name: nameRef[:i], HashName: extract.DefaultHashName}
+	ref := &extract.Ref{Name: nameRef[i+1:], Layout: el}
+	if _, err := os.Stat(ref.RootFS()); err != nil {
+		return err
+	}
+	g, err := ref.Rollback(n)
+	if err != nil {
+		return fmt.Errorf("%s: %s", nameRef, err)
+	}
+	fmt.Printf("%s is now generation %d (config %s, extracted %s)\n", nameRef, g.Number, g.Config, g.Created.Format(time.RFC3339))
+	fmt.Println("INFO: run `systemctl daemon-reload` and restart the service for it to take effect")
+	return nil
+}
+
+// gc removes what is not linked from the extracted refs of the live layouts
+func gc(cfg *config.OCIGenConfig, layouts layout.Layouts, dryRun bool) error {
+	// an interrupted extraction is not to be collected, but cleaned up
+	if !dryRun {
+		if _, err := extract.CleanIncomplete(cfg.ExtractsDir); err != nil {
+			return err
+		}
+	}
+	result, err := extract.GC(cfg.ExtractsDir, layouts, extract.GCOptions{
+		DryRun:      dryRun,
+		KeepOrphans: cfg.KeepOrphans,
+		MinAge:      cfg.GCMinAge,
+	})
+	if err != nil {
+		return err
+	}
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	for _, paths := range [][]string{result.Refs, result.Configs, result.ChainIDs, result.Layers, result.Verified} {
+		for _, path := range paths {
+			fmt.Printf("%s %q\n", verb, path)
+		}
+	}
+	for _, path := range result.Mounted {
+		fmt.Printf("WARN: kept orphaned %q, as it is still mounted\n", path)
+	}
+	fmt.Printf("INFO: %s %d orphaned refs, %d configs, %d rootfs, %d layers and %d verified blob records\n", verb, len(result.Refs), len(result.Configs), len(result.ChainIDs), len(result.Layers), len(result.Verified))
+	return nil
 }
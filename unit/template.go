@@ -29,6 +29,36 @@ func RootDirectory(path string) (*unit.UnitOption, error) {
 	return unit.NewUnitOption("Service", "RootDirectory", path), nil
 }
 
+// MountName is the name of the .mount unit for the mount point where (see
+// systemd.mount(5))
+func MountName(where string) string {
+	return unit.UnitNamePathEscape(where) + ".mount"
+}
+
+// Mount provides the unit file options of a .mount unit, mounting what at
+// where (see systemd.mount(5)).
+func Mount(what, where, fsType, options string) ([]*unit.UnitOption, error) {
+	if !strings.HasPrefix(where, "/") {
+		return nil, fmt.Errorf("expected absolute path; got %q", where)
+	}
+	return []*unit.UnitOption{
+		unit.NewUnitOption("Unit", "Description", "OCI: %f"),
+		unit.NewUnitOption("Mount", "What", what),
+		unit.NewUnitOption("Mount", "Where", where),
+		unit.NewUnitOption("Mount", "Type", fsType),
+		unit.NewUnitOption("Mount", "Options", options),
+	}, nil
+}
+
+// Requires provides the Requires= and After= of the unit name, so that it is
+// started before (and stopped after) this unit file.
+func Requires(name string) []*unit.UnitOption {
+	return []*unit.UnitOption{
+		unit.NewUnitOption("Unit", "Requires", name),
+		unit.NewUnitOption("Unit", "After", name),
+	}
+}
+
 // ExecStart provides the unit file option for ExecStart=, given a command string
 func ExecStart(cmd string) (*unit.UnitOption, error) {
 	// if the command is not an absolute path
@@ -74,3 +74,35 @@ func TestRootDirectory(t *testing.T) {
 		t.Errorf("Expected unit value of %q; got %q", expect, u.Value)
 	}
 }
+
+func TestMount(t *testing.T) {
+	where := "/var/lib/oci/extracts/names/example.com/myapp/stable/overlay/merged"
+	expect := "var-lib-oci-extracts-names-example.com-myapp-stable-overlay-merged.mount"
+	if got := MountName(where); got != expect {
+		t.Errorf("expected %q; got %q", expect, got)
+	}
+
+	units, err := Mount("overlay", where, "overlay", "lowerdir=/a:/b,upperdir=/c,workdir=/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, u := range units {
+		if u.Section == "Mount" {
+			found[u.Name] = u.Value
+		}
+	}
+	if found["Where"] != where || found["Type"] != "overlay" || found["Options"] != "lowerdir=/a:/b,upperdir=/c,workdir=/d" {
+		t.Errorf("unexpected [Mount] options: %v", found)
+	}
+
+	if _, err := Mount("overlay", "merged", "overlay", ""); err == nil {
+		t.Error("expected an error for a relative mount point")
+	}
+
+	for _, u := range Requires(expect) {
+		if u.Section != "Unit" || u.Value != expect {
+			t.Errorf("expected [Unit] %s=%s; got [%s] %s=%s", u.Name, expect, u.Section, u.Name, u.Value)
+		}
+	}
+}
@@ -24,3 +24,8 @@ func Debugf(format string, a ...interface{}) (n int, err error) {
 	}
 	return 0, nil
 }
+
+// Warnf writes formatted output to DebugOutput, whether or not DEBUG is set
+func Warnf(format string, a ...interface{}) (n int, err error) {
+	return fmt.Fprintf(DebugOutput, "[%d] [WARN] %s\n", time.Now().UnixNano(), fmt.Sprintf(format, a...))
+}
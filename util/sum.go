@@ -3,9 +3,12 @@ package util
 import (
 	"crypto"
 	_ "crypto/sha256" // this is for the HashMap
+	_ "crypto/sha512" // this is for the HashMap
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
 )
 
 // SumContent calculates the hexidecimal digest of the content in r, with
@@ -31,4 +34,52 @@ var ErrNoHash = errors.New("no such hash in HashMap")
 // "sha256:ea2bedaf251...", to the crypto.Hash that provides the hash.
 var HashMap = map[string]crypto.Hash{
 	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// RegisterHash adds hashName (as it is found in digests) to the HashMap. The
+// hash implementation must be linked into the binary.
+func RegisterHash(hashName string, hash crypto.Hash) error {
+	if !algorithmRegexp.MatchString(hashName) {
+		return fmt.Errorf("invalid hash name %q", hashName)
+	}
+	if !hash.Available() {
+		return fmt.Errorf("hash for %q is not available", hashName)
+	}
+	HashMap[hashName] = hash
+	return nil
+}
+
+// Errors for digests that do not pass ValidateDigest. These are the same
+// conditions as github.com/opencontainers/go-digest.
+var (
+	ErrDigestInvalidFormat = errors.New("invalid checksum digest format")
+	ErrDigestInvalidLength = errors.New("invalid checksum digest length")
+	ErrDigestUnsupported   = errors.New("unsupported digest algorithm")
+)
+
+var (
+	algorithmRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*$`)
+	encodedRegexp   = regexp.MustCompile(`^[a-f0-9]+$`)
+)
+
+// ValidateDigest checks that digest is of the form "<algorithm>:<hex>", the
+// algorithm is in the HashMap, and the hex is lowercase and the length of
+// that hash's sum.
+func ValidateDigest(digest string) error {
+	chunks := strings.SplitN(digest, ":", 2)
+	if len(chunks) != 2 || chunks[1] == "" || !algorithmRegexp.MatchString(chunks[0]) {
+		return ErrDigestInvalidFormat
+	}
+	hash, ok := HashMap[chunks[0]]
+	if !ok {
+		return ErrDigestUnsupported
+	}
+	if len(chunks[1]) != hash.Size()*2 {
+		return ErrDigestInvalidLength
+	}
+	if !encodedRegexp.MatchString(chunks[1]) {
+		return ErrDigestInvalidFormat
+	}
+	return nil
 }
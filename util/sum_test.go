@@ -1,23 +1,67 @@
 package util
 
 import (
+	"crypto"
 	"os"
 	"testing"
 )
 
 func TestSum(t *testing.T) {
-	expect := "ad629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e72"
-	fh, err := os.Open("./testdata/rando.img")
-	if err != nil {
-		t.Fatal(err)
+	for hashName, expect := range map[string]string{
+		"sha256": "ad629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e72",
+		"sha512": "ab0979ff5659e0aa3c3ebe572330da179c5a11a7434ffb7d57ff5cb9e2c2f51e74551ab62bde678b89f31a35fc7c9455645a2b2d7cd9151123c71aebbbcfdbb2",
+	} {
+		fh, err := os.Open("./testdata/rando.img")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := SumContent(hashName, fh)
+		fh.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != expect {
+			t.Errorf("%s: expected %q; got %q", hashName, expect, got)
+		}
 	}
 
-	got, err := SumContent("sha256", fh)
-	if err != nil {
-		t.Fatal(err)
+	if _, err := SumContent("md5", nil); err != ErrNoHash {
+		t.Errorf("expected %q; got %v", ErrNoHash, err)
 	}
+}
 
-	if got != expect {
-		t.Errorf("expected %q; got %q", expect, got)
+func TestValidateDigest(t *testing.T) {
+	for digest, expect := range map[string]error{
+		"sha256:ad629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e72":                                                                 nil,
+		"sha512:ab0979ff5659e0aa3c3ebe572330da179c5a11a7434ffb7d57ff5cb9e2c2f51e74551ab62bde678b89f31a35fc7c9455645a2b2d7cd9151123c71aebbbcfdbb2": nil,
+		"sha256:AD629855562843EAB84EF000F05D4D801774C48A7996DD5B38D03C5B0C0E9E72":                                                                 ErrDigestInvalidFormat,
+		"sha256:ad629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e7":                                                                  ErrDigestInvalidLength,
+		"sha512:ad629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e72":                                                                 ErrDigestInvalidLength,
+		"sha256:../../../../../../../../../../../../../../../../../etc/passwd":                                                                    ErrDigestInvalidLength,
+		"sha256:zz629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e72":                                                                 ErrDigestInvalidFormat,
+		"md5:d41d8cd98f00b204e9800998ecf8427e":                                                                                                    ErrDigestUnsupported,
+		"ad629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e72":                                                                        ErrDigestInvalidFormat,
+		"SHA256:ad629855562843eab84ef000f05d4d801774c48a7996dd5b38d03c5b0c0e9e72":                                                                 ErrDigestInvalidFormat,
+		"sha256:": ErrDigestInvalidFormat,
+	} {
+		if err := ValidateDigest(digest); err != expect {
+			t.Errorf("%q: expected %v; got %v", digest, expect, err)
+		}
+	}
+}
+
+func TestRegisterHash(t *testing.T) {
+	if err := RegisterHash("Bad Name", crypto.SHA384); err == nil {
+		t.Errorf("expected an error for an invalid hash name")
+	}
+	if err := RegisterHash("sha384", crypto.SHA384); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(HashMap, "sha384")
+	digest := "sha384:38b060a751ac96384cd9327eb1b1e36a21fdb71114be07434c0cc7bf63f6e1da274edebfe76f65fbd51ad2f14898b95b"
+	if err := ValidateDigest(digest); err != nil {
+		t.Errorf("%q: %s", digest, err)
 	}
 }